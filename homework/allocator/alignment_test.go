@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlignedAllocation(t *testing.T) {
+	arena, err := NewArena(128)
+	assert.NoError(t, err)
+
+	small, err := arena.Alloc(8)
+	assert.NoError(t, err)
+	aligned, err := arena.AllocAligned(8, 16)
+	assert.NoError(t, err)
+	assert.Zero(t, uintptr(aligned)%16)
+	assert.Equal(t, "H#.H#...\n........\n", arena.Render(8))
+
+	_, err = arena.AllocAligned(8, 32)
+	assert.Error(t, err)
+	_, err = arena.AllocAligned(8, 3)
+	assert.Error(t, err)
+
+	*(*uint64)(aligned) = 0x1122334455667788
+	handle, err := arena.AllocHandleAligned(16, 16)
+	assert.NoError(t, err)
+	assert.NoError(t, arena.Free(small))
+
+	stats, err := arena.Compact()
+	assert.NoError(t, err)
+	assert.Equal(t, CompactStats{MovedBlocks: 2, MovedBytes: 40, PaddingBytes: 8}, stats)
+	assert.Equal(t, ".H#H##..\n........\n", arena.Render(8))
+
+	ptr, err := arena.Resolve(handle)
+	assert.NoError(t, err)
+	assert.Zero(t, uintptr(ptr)%16)
+	assert.Equal(t, uint64(0x1122334455667788), *(*uint64)(unsafe.Pointer(&arena.memory[16])))
+}
+
+func TestDefragmenterKeepsAlignment(t *testing.T) {
+	arena, err := NewArena(128)
+	assert.NoError(t, err)
+
+	var handles []Handle
+	for _, align := range []int{1, 16, 1, 16} {
+		handle, err := arena.AllocHandleAligned(8, align)
+		assert.NoError(t, err)
+		handles = append(handles, handle)
+	}
+	assert.Equal(t, "H#.H#H#H\n#.......\n", arena.Render(8))
+	assert.NoError(t, arena.FreeHandle(handles[0]))
+	assert.NoError(t, arena.FreeHandle(handles[2]))
+
+	defragmenter := NewDefragmenter(arena)
+	for done := false; !done; {
+		done, err = defragmenter.Step(Budget{Objects: 1})
+		assert.NoError(t, err)
+		assert.NoError(t, validateBlocks(arena.memory))
+	}
+	assert.Equal(t, ".H#H#...\n........\n", arena.Render(8))
+
+	for _, i := range []int{1, 3} {
+		ptr, err := arena.Resolve(handles[i])
+		assert.NoError(t, err)
+		assert.Zero(t, uintptr(ptr)%16)
+	}
+}
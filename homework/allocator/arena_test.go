@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	ErrOutOfMemory    = errors.New("out of memory")
+	ErrInvalidPointer = errors.New("invalid pointer")
+)
+
+// Arena owns a memory region laid out as blocks (see block_test.go).
+// Compact moves live blocks, so raw pointers returned by Alloc are only
+// valid until the next compaction, which Alloc itself may trigger.
+// Code that keeps references across compactions should use handles.
+type Arena struct {
+	memory      []byte
+	strategy    Strategy
+	compactions int
+
+	// handle table: pointers[slot] is the payload of a live block or nil
+	pointers    []unsafe.Pointer
+	sizes       []int
+	generations []uint32
+	freeSlots   []int
+
+	sanitize bool
+	freed    map[uintptr]struct{}
+	moved    map[uintptr]uintptr
+}
+
+type ArenaOption func(*Arena)
+
+func WithStrategy(strategy Strategy) ArenaOption {
+	return func(a *Arena) {
+		a.strategy = strategy
+	}
+}
+
+func NewArena(size int, options ...ArenaOption) (*Arena, error) {
+	size = alignUp(size, blockAlignment)
+	memory := make([]byte, size+maxAlignment)
+	start := payloadPadding(memory, 0, maxAlignment)
+	memory = memory[start : start+size : start+size]
+	if err := FormatBlocks(memory); err != nil {
+		return nil, err
+	}
+	return newArena(memory, options), nil
+}
+
+// newArena wraps memory that already holds valid blocks. The base of the
+// memory must be aligned to maxAlignment.
+func newArena(memory []byte, options []ArenaOption) *Arena {
+	arena := &Arena{memory: memory, strategy: FirstFit{}}
+	for _, opt := range options {
+		opt(arena)
+	}
+	return arena
+}
+
+func (a *Arena) payloadOffset() int {
+	if a.sanitize {
+		return headerSize + redZoneSize
+	}
+	return headerSize
+}
+
+func (a *Arena) blockSizeFor(size int) int {
+	if a.sanitize {
+		return alignUp(headerSize+redZoneSize+size+redZoneSize, blockAlignment)
+	}
+	return alignUp(headerSize+max(size, 1), blockAlignment)
+}
+
+func (a *Arena) Alloc(size int) (unsafe.Pointer, error) {
+	return a.AllocAligned(size, 1)
+}
+
+// AllocAligned returns a payload whose address is a multiple of align
+// (1, 2, 4, 8 or 16); compaction keeps that alignment.
+func (a *Arena) AllocAligned(size, align int) (unsafe.Pointer, error) {
+	slot, err := a.alloc(size, align)
+	if err != nil {
+		return nil, err
+	}
+	return a.pointers[slot], nil
+}
+
+func (a *Arena) Free(ptr unsafe.Pointer) error {
+	if _, err := a.blockOffset(ptr); err != nil {
+		return a.diagnosePointer(ptr, ErrDoubleFree, err)
+	}
+	slot := slices.Index(a.pointers, ptr)
+	if slot < 0 {
+		return fmt.Errorf("%w: %p is not tracked by the arena", ErrInvalidPointer, ptr)
+	}
+	return a.release(slot)
+}
+
+func (a *Arena) alloc(size, align int) (int, error) {
+	slot, err := a.allocNoCompact(size, align)
+	if !errors.Is(err, ErrOutOfMemory) || !a.compactionMayFit(size) {
+		return slot, err
+	}
+	if _, err := a.Compact(); err != nil {
+		return 0, err
+	}
+	return a.allocNoCompact(size, align)
+}
+
+// compactionMayFit tells whether the free bytes joined into one block
+// could hold the request. Compaction invalidates every raw pointer, so it
+// is not done for requests that cannot fit anyway.
+func (a *Arena) compactionMayFit(size int) bool {
+	if size > len(a.memory) {
+		return false
+	}
+	total := 0
+	for _, block := range a.freeBlocks() {
+		total += block.size
+	}
+	return a.blockSizeFor(size) <= total
+}
+
+func (a *Arena) allocNoCompact(size, align int) (int, error) {
+	if size < 0 {
+		return 0, fmt.Errorf("negative allocation size %d", size)
+	}
+	if !isPowerOfTwo(align) || align > maxAlignment {
+		return 0, fmt.Errorf("unsupported alignment %d", align)
+	}
+	// checked before computing the block size, which would overflow
+	if size > len(a.memory) {
+		return 0, fmt.Errorf("%w: requested %d bytes", ErrOutOfMemory, size)
+	}
+	blockSize := a.blockSizeFor(size)
+	offset, padding := a.findFree(blockSize, align)
+	if offset < 0 {
+		return 0, fmt.Errorf("%w: requested %d bytes", ErrOutOfMemory, size)
+	}
+
+	offset = a.split(offset, padding, blockSize, uint8(bits.TrailingZeros(uint(align))))
+	if a.sanitize {
+		a.paintRedZones(offset, size)
+	}
+	return a.takeSlot(unsafe.Pointer(&a.memory[offset+a.payloadOffset()]), size), nil
+}
+
+func (a *Arena) release(slot int) error {
+	offset, err := a.blockOffset(a.pointers[slot])
+	if err != nil {
+		return err
+	}
+	header := readHeader(a.memory, offset)
+	clear(a.memory[offset+headerSize : offset+header.size])
+	writeHeader(a.memory, offset, blockHeader{size: header.size})
+	a.coalesce()
+	if a.sanitize {
+		a.freed[uintptr(a.pointers[slot])] = struct{}{}
+		a.poisonFree()
+	}
+	a.releaseSlot(slot)
+	return nil
+}
+
+func (a *Arena) Compact() (CompactStats, error) {
+	a.compactions++
+	before := a.snapshot()
+	stats, err := DefragmentBlocks(a.memory, a.pointers)
+	a.afterMove(before)
+	return stats, err
+}
+
+// Compactions reports how many times the arena has been compacted.
+func (a *Arena) Compactions() int {
+	return a.compactions
+}
+
+// findFree returns the free block chosen by the strategy and the padding
+// needed in front of the new block to align its payload.
+func (a *Arena) findFree(blockSize, align int) (int, int) {
+	free := a.freeBlocks()
+	candidates := make([]freeBlock, 0, len(free))
+	for _, block := range free {
+		padding := payloadPadding(a.memory, block.offset+a.payloadOffset(), align)
+		candidates = append(candidates, freeBlock{offset: block.offset + padding, size: block.size - padding})
+	}
+	if idx := a.strategy.Place(candidates, blockSize); idx >= 0 {
+		return free[idx].offset, candidates[idx].offset - free[idx].offset
+	}
+	return -1, 0
+}
+
+func (a *Arena) freeBlocks() []freeBlock {
+	var free []freeBlock
+	for offset := 0; offset < len(a.memory); {
+		header := readHeader(a.memory, offset)
+		if !header.allocated() {
+			free = append(free, freeBlock{offset: offset, size: header.size})
+		}
+		offset += header.size
+	}
+	return free
+}
+
+func (a *Arena) split(offset, padding, blockSize int, alignShift uint8) int {
+	header := readHeader(a.memory, offset)
+	if padding > 0 {
+		writeHeader(a.memory, offset, blockHeader{size: padding})
+		offset += padding
+		header.size -= padding
+	}
+	if rest := header.size - blockSize; rest >= headerSize {
+		writeHeader(a.memory, offset+blockSize, blockHeader{size: rest})
+		header.size = blockSize
+	}
+	header.flags |= flagAllocated
+	if a.sanitize {
+		header.flags |= flagRedZones
+	}
+	header.alignShift = alignShift
+	writeHeader(a.memory, offset, header)
+	return offset
+}
+
+func (a *Arena) coalesce() {
+	for offset := 0; offset < len(a.memory); {
+		header := readHeader(a.memory, offset)
+		next := offset + header.size
+		if !header.allocated() && next < len(a.memory) {
+			if nextHeader := readHeader(a.memory, next); !nextHeader.allocated() {
+				header.size += nextHeader.size
+				clear(a.memory[next : next+headerSize])
+				writeHeader(a.memory, offset, header)
+				continue
+			}
+		}
+		offset = next
+	}
+}
+
+func (a *Arena) blockOffset(ptr unsafe.Pointer) (int, error) {
+	base := uintptr(unsafe.Pointer(unsafe.SliceData(a.memory)))
+	addr := uintptr(ptr)
+	if addr < base+headerSize || addr >= base+uintptr(len(a.memory)) {
+		return 0, fmt.Errorf("%w: %p is outside of the arena", ErrInvalidPointer, ptr)
+	}
+	// the payload offset is taken from every header: blocks allocated
+	// without red zones keep working after the sanitizer is turned on
+	target := int(addr - base)
+	for offset := 0; offset < target; {
+		header := readHeader(a.memory, offset)
+		if header.allocated() && offset+header.payloadOffset() == target {
+			return offset, nil
+		}
+		offset += header.size
+	}
+	return 0, fmt.Errorf("%w: %p is not an allocated block", ErrInvalidPointer, ptr)
+}
+
+func TestArenaAllocFree(t *testing.T) {
+	arena, err := NewArena(64)
+	assert.NoError(t, err)
+
+	first, err := arena.Alloc(10)
+	assert.NoError(t, err)
+	second, err := arena.Alloc(4)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&arena.memory[headerSize]), first)
+	assert.Equal(t, unsafe.Pointer(&arena.memory[24+headerSize]), second)
+
+	*(*uint32)(second) = 0xDEADBEEF
+	assert.NoError(t, arena.Free(first))
+	assert.ErrorIs(t, arena.Free(first), ErrInvalidPointer)
+	assert.ErrorIs(t, arena.Free(unsafe.Add(second, 1)), ErrInvalidPointer)
+
+	reused, err := arena.Alloc(16)
+	assert.NoError(t, err)
+	assert.Equal(t, first, reused)
+	assert.Equal(t, uint32(0xDEADBEEF), *(*uint32)(second))
+}
+
+func TestArenaCompactsBeforeOutOfMemory(t *testing.T) {
+	arena, err := NewArena(64)
+	assert.NoError(t, err)
+
+	var pointers []unsafe.Pointer
+	for range 4 {
+		ptr, err := arena.Alloc(8)
+		assert.NoError(t, err)
+		pointers = append(pointers, ptr)
+	}
+	*(*uint64)(pointers[1]) = 0x0102030405060708
+	assert.NoError(t, arena.Free(pointers[0]))
+	assert.NoError(t, arena.Free(pointers[2]))
+
+	// 32 free bytes cannot hold a 48 byte block, so nothing is moved
+	_, err = arena.Alloc(40)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	assert.Zero(t, arena.Compactions())
+
+	ptr, err := arena.Alloc(24)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&arena.memory[32+headerSize]), ptr)
+	assert.Equal(t, uint64(0x0102030405060708), *(*uint64)(unsafe.Pointer(&arena.memory[headerSize])))
+
+	assert.Equal(t, 1, arena.Compactions())
+
+	// requests that cannot fit even after compaction leave the blocks in place
+	_, err = arena.Alloc(1)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	_, err = arena.Alloc(math.MaxInt - 4)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	assert.Equal(t, 1, arena.Compactions())
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Block layout: every block starts with an 8 byte header (size uint32
+// including the header, flags uint16, log2 of the payload alignment uint8,
+// one unused byte) followed by the payload. Blocks allocated in sanitizer
+// mode have red zones around the payload (see sanitizer_test.go).
+// Blocks tile the whole memory region without gaps.
+
+const (
+	headerSize     = 8
+	blockAlignment = 8
+	maxAlignment   = 16
+
+	flagAllocated uint16 = 1 << 0
+	flagRedZones  uint16 = 1 << 1
+)
+
+var ErrCorruptedBlock = errors.New("corrupted block header")
+
+type blockHeader struct {
+	size       int
+	flags      uint16
+	alignShift uint8
+}
+
+func (h blockHeader) allocated() bool {
+	return h.flags&flagAllocated != 0
+}
+
+func (h blockHeader) alignment() int {
+	return 1 << h.alignShift
+}
+
+func (h blockHeader) payloadOffset() int {
+	if h.flags&flagRedZones != 0 {
+		return headerSize + redZoneSize
+	}
+	return headerSize
+}
+
+func readHeader(memory []byte, offset int) blockHeader {
+	return blockHeader{
+		size:       int(binary.LittleEndian.Uint32(memory[offset:])),
+		flags:      binary.LittleEndian.Uint16(memory[offset+4:]),
+		alignShift: memory[offset+6],
+	}
+}
+
+func writeHeader(memory []byte, offset int, header blockHeader) {
+	binary.LittleEndian.PutUint32(memory[offset:], uint32(header.size))
+	binary.LittleEndian.PutUint16(memory[offset+4:], header.flags)
+	memory[offset+6] = header.alignShift
+	memory[offset+7] = 0
+}
+
+// payloadPadding returns how many bytes a block has to be shifted so that
+// the payload at the given offset gets an address that is a multiple of
+// align. The result is a multiple of blockAlignment, so the padding itself
+// is a valid free block.
+func payloadPadding(memory []byte, payload, align int) int {
+	if align <= blockAlignment {
+		return 0
+	}
+	addr := uintptr(unsafe.Pointer(unsafe.SliceData(memory))) + uintptr(payload)
+	return int(uintptr(alignUp(int(addr), align)) - addr)
+}
+
+func alignUp(value, align int) int {
+	return (value + align - 1) &^ (align - 1)
+}
+
+// FormatBlocks turns the whole memory into a single free block.
+func FormatBlocks(memory []byte) error {
+	if len(memory) < headerSize || len(memory)%blockAlignment != 0 {
+		return fmt.Errorf("memory size %d is not a positive multiple of %d", len(memory), blockAlignment)
+	}
+	clear(memory)
+	writeHeader(memory, 0, blockHeader{size: len(memory)})
+	return nil
+}
+
+func validateBlocks(memory []byte) error {
+	for offset := 0; offset < len(memory); {
+		if len(memory)-offset < headerSize {
+			return fmt.Errorf("%w: truncated header at offset %d", ErrCorruptedBlock, offset)
+		}
+		header := readHeader(memory, offset)
+		if header.size < headerSize || header.size%blockAlignment != 0 || header.size > len(memory)-offset {
+			return fmt.Errorf("%w: invalid size %d at offset %d", ErrCorruptedBlock, header.size, offset)
+		}
+		offset += header.size
+	}
+	return nil
+}
+
+type blockMove struct {
+	from, to, size int
+}
+
+type CompactStats struct {
+	MovedBlocks int
+	MovedBytes  int
+	// PaddingBytes are kept as small free blocks in front of blocks whose
+	// payload alignment is larger than blockAlignment.
+	PaddingBytes int
+}
+
+// DefragmentBlocks slides every allocated block down to the beginning of
+// the memory, keeping the payload alignment of every block, merges the
+// rest into one free block and rewrites pointers that referenced the start
+// or the interior of a moved block.
+func DefragmentBlocks(memory []byte, pointers []unsafe.Pointer) (CompactStats, error) {
+	var stats CompactStats
+	if err := validateBlocks(memory); err != nil {
+		return stats, err
+	}
+
+	var moves []blockMove
+	write := 0
+	for read := 0; read < len(memory); {
+		header := readHeader(memory, read)
+		if header.allocated() {
+			if padding := payloadPadding(memory, write+header.payloadOffset(), header.alignment()); padding > 0 && write+padding <= read {
+				clear(memory[write : write+padding])
+				writeHeader(memory, write, blockHeader{size: padding})
+				stats.PaddingBytes += padding
+				write += padding
+			}
+			if read != write {
+				copy(memory[write:], memory[read:read+header.size])
+				moves = append(moves, blockMove{from: read, to: write, size: header.size})
+				stats.MovedBlocks++
+				stats.MovedBytes += header.size
+			}
+			write += header.size
+		}
+		read += header.size
+	}
+
+	if write < len(memory) {
+		clear(memory[write:])
+		writeHeader(memory, write, blockHeader{size: len(memory) - write})
+	}
+
+	relocatePointers(memory, moves, pointers)
+	return stats, nil
+}
+
+func relocatePointers(memory []byte, moves []blockMove, pointers []unsafe.Pointer) {
+	if len(moves) == 0 {
+		return
+	}
+	base := uintptr(unsafe.Pointer(unsafe.SliceData(memory)))
+	for i, ptr := range pointers {
+		addr := uintptr(ptr)
+		if ptr == nil || addr < base || addr >= base+uintptr(len(memory)) {
+			continue
+		}
+		offset := int(addr - base)
+		idx := sort.Search(len(moves), func(i int) bool {
+			return moves[i].from+moves[i].size > offset
+		})
+		if idx == len(moves) || moves[idx].from > offset {
+			continue
+		}
+		pointers[i] = unsafe.Add(ptr, moves[idx].to-moves[idx].from)
+	}
+}
+
+func TestDefragmentBlocks(t *testing.T) {
+	memory := make([]byte, 96)
+	assert.NoError(t, FormatBlocks(memory))
+
+	// [free 16][alloc 24][free 8][alloc 16][free 32]
+	writeHeader(memory, 0, blockHeader{size: 16})
+	writeHeader(memory, 16, blockHeader{size: 24, flags: flagAllocated})
+	copy(memory[16+headerSize:], []byte{1, 0, 0, 4, 5, 6, 0, 8, 9, 10, 11, 12, 13, 14, 15, 0})
+	writeHeader(memory, 40, blockHeader{size: 8})
+	writeHeader(memory, 48, blockHeader{size: 16, flags: flagAllocated})
+	copy(memory[48+headerSize:], []byte{0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF, 0x11, 0x22})
+	writeHeader(memory, 64, blockHeader{size: 32})
+
+	pointers := []unsafe.Pointer{
+		unsafe.Pointer(&memory[48+headerSize]),
+		unsafe.Pointer(&memory[16+headerSize]),
+		unsafe.Pointer(&memory[16+headerSize+5]),
+		unsafe.Pointer(&memory[48+headerSize+7]),
+	}
+
+	stats, err := DefragmentBlocks(memory, pointers)
+	assert.NoError(t, err)
+	assert.Equal(t, CompactStats{MovedBlocks: 2, MovedBytes: 40}, stats)
+
+	assert.Equal(t, blockHeader{size: 24, flags: flagAllocated}, readHeader(memory, 0))
+	assert.Equal(t, []byte{1, 0, 0, 4, 5, 6, 0, 8, 9, 10, 11, 12, 13, 14, 15, 0}, memory[headerSize:24])
+	assert.Equal(t, blockHeader{size: 16, flags: flagAllocated}, readHeader(memory, 24))
+	assert.Equal(t, []byte{0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF, 0x11, 0x22}, memory[24+headerSize:40])
+	assert.Equal(t, blockHeader{size: 56}, readHeader(memory, 40))
+
+	expectedPointers := []unsafe.Pointer{
+		unsafe.Pointer(&memory[24+headerSize]),
+		unsafe.Pointer(&memory[headerSize]),
+		unsafe.Pointer(&memory[headerSize+5]),
+		unsafe.Pointer(&memory[24+headerSize+7]),
+	}
+	assert.Equal(t, expectedPointers, pointers)
+}
+
+func TestDefragmentBlocksCorrupted(t *testing.T) {
+	memory := make([]byte, 32)
+	writeHeader(memory, 0, blockHeader{size: 12, flags: flagAllocated})
+
+	_, err := DefragmentBlocks(memory, nil)
+	assert.ErrorIs(t, err, ErrCorruptedBlock)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Buddy is a binary buddy allocator over a memory region whose size is
+// a power of two. Blocks never move, so pointers stay valid until Free.
+// Block of order k has size minBlock << k.
+type Buddy struct {
+	memory    []byte
+	minBlock  int
+	maxOrder  int
+	freeLists [][]int     // offsets of free blocks per order
+	allocated map[int]int // offset -> order of allocated blocks
+}
+
+type BuddyOrderStats struct {
+	Order     int
+	BlockSize int
+	Free      []int
+}
+
+func NewBuddy(memory []byte, minBlock int) (*Buddy, error) {
+	if !isPowerOfTwo(minBlock) || !isPowerOfTwo(len(memory)) || len(memory) < minBlock {
+		return nil, fmt.Errorf("memory size %d and min block %d must be powers of two", len(memory), minBlock)
+	}
+	maxOrder := bits.TrailingZeros(uint(len(memory) / minBlock))
+	buddy := &Buddy{
+		memory:    memory,
+		minBlock:  minBlock,
+		maxOrder:  maxOrder,
+		freeLists: make([][]int, maxOrder+1),
+		allocated: make(map[int]int),
+	}
+	buddy.freeLists[maxOrder] = []int{0}
+	return buddy, nil
+}
+
+func isPowerOfTwo(value int) bool {
+	return value > 0 && value&(value-1) == 0
+}
+
+func (b *Buddy) orderFor(size int) int {
+	order := 0
+	for b.minBlock<<order < size {
+		order++
+	}
+	return order
+}
+
+func (b *Buddy) Alloc(size int) (unsafe.Pointer, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("negative allocation size %d", size)
+	}
+	// orderFor would overflow for sizes beyond the memory region
+	if size > len(b.memory) {
+		return nil, fmt.Errorf("%w: requested %d bytes", ErrOutOfMemory, size)
+	}
+	order := b.orderFor(max(size, 1))
+
+	current := order
+	for current <= b.maxOrder && len(b.freeLists[current]) == 0 {
+		current++
+	}
+	if current > b.maxOrder {
+		return nil, fmt.Errorf("%w: requested %d bytes", ErrOutOfMemory, size)
+	}
+
+	offset := b.popFree(current)
+	for current > order {
+		current--
+		b.pushFree(current, offset+b.minBlock<<current)
+	}
+
+	b.allocated[offset] = order
+	return unsafe.Pointer(&b.memory[offset]), nil
+}
+
+func (b *Buddy) Free(ptr unsafe.Pointer) error {
+	base := uintptr(unsafe.Pointer(unsafe.SliceData(b.memory)))
+	offset := int(uintptr(ptr) - base)
+	order, ok := b.allocated[offset]
+	if uintptr(ptr) < base || !ok {
+		return fmt.Errorf("%w: %p is not an allocated buddy block", ErrInvalidPointer, ptr)
+	}
+	delete(b.allocated, offset)
+	clear(b.memory[offset : offset+b.minBlock<<order])
+
+	for order < b.maxOrder {
+		buddy := offset ^ b.minBlock<<order
+		idx := slices.Index(b.freeLists[order], buddy)
+		if idx < 0 {
+			break
+		}
+		b.freeLists[order] = slices.Delete(b.freeLists[order], idx, idx+1)
+		offset = min(offset, buddy)
+		order++
+	}
+	b.pushFree(order, offset)
+	return nil
+}
+
+// FreeLists reports free block offsets for every order.
+func (b *Buddy) FreeLists() []BuddyOrderStats {
+	stats := make([]BuddyOrderStats, 0, b.maxOrder+1)
+	for order, free := range b.freeLists {
+		stats = append(stats, BuddyOrderStats{
+			Order:     order,
+			BlockSize: b.minBlock << order,
+			Free:      slices.Sorted(slices.Values(free)),
+		})
+	}
+	return stats
+}
+
+func (b *Buddy) pushFree(order, offset int) {
+	b.freeLists[order] = append(b.freeLists[order], offset)
+}
+
+func (b *Buddy) popFree(order int) int {
+	list := b.freeLists[order]
+	offset := list[len(list)-1]
+	b.freeLists[order] = list[:len(list)-1]
+	return offset
+}
+
+func freeOffsets(b *Buddy) [][]int {
+	var result [][]int
+	for _, stats := range b.FreeLists() {
+		result = append(result, stats.Free)
+	}
+	return result
+}
+
+func TestBuddySplitAndCoalesce(t *testing.T) {
+	memory := make([]byte, 128)
+	buddy, err := NewBuddy(memory, 16)
+	assert.NoError(t, err)
+
+	first, err := buddy.Alloc(10)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[0]), first)
+	assert.Equal(t, [][]int{{16}, {32}, {64}, nil}, freeOffsets(buddy))
+
+	second, err := buddy.Alloc(32)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[32]), second)
+
+	third, err := buddy.Alloc(16)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[16]), third)
+	assert.Equal(t, [][]int{nil, nil, {64}, nil}, freeOffsets(buddy))
+
+	*(*uint64)(second) = 42
+	assert.NoError(t, buddy.Free(first))
+	assert.ErrorIs(t, buddy.Free(first), ErrInvalidPointer)
+	assert.NoError(t, buddy.Free(third))
+	assert.Equal(t, [][]int{nil, {0}, {64}, nil}, freeOffsets(buddy))
+	assert.Equal(t, uint64(42), *(*uint64)(second))
+
+	assert.NoError(t, buddy.Free(second))
+	assert.Equal(t, [][]int{nil, nil, nil, {0}}, freeOffsets(buddy))
+}
+
+func TestBuddyOutOfMemory(t *testing.T) {
+	buddy, err := NewBuddy(make([]byte, 64), 16)
+	assert.NoError(t, err)
+
+	_, err = buddy.Alloc(65)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	_, err = buddy.Alloc(math.MaxInt)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	_, err = buddy.Alloc(-5)
+	assert.Error(t, err)
+
+	_, err = buddy.Alloc(48)
+	assert.NoError(t, err)
+	_, err = buddy.Alloc(1)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+
+	_, err = NewBuddy(make([]byte, 96), 16)
+	assert.Error(t, err)
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	cacheBatch = 4
+	cacheLimit = 16
+)
+
+// ConcurrentArena shares one Arena between goroutines. Every goroutine
+// works through its own LocalCache, which serves small blocks from local
+// free lists without locks; the central arena is protected by mu.
+//
+// Compaction stops the world: it takes mu, raises stopping and waits until
+// no cache is inside an operation. A cache announces an operation with
+// inFlight before it checks stopping, so either the compactor waits for it
+// or the cache waits for the compactor, and nobody sees a half-moved block.
+type ConcurrentArena struct {
+	mu       sync.Mutex
+	arena    *Arena
+	caches   map[*LocalCache]struct{}
+	stopping atomic.Bool
+}
+
+// LocalCache must be used by one goroutine only. Handles belong to the
+// cache that allocated them.
+type LocalCache struct {
+	central  *ConcurrentArena
+	inFlight atomic.Bool
+
+	free    [][]Handle // cached free blocks per size class
+	cached  map[Handle]struct{}
+	classes map[Handle]int
+	// ptrs keeps addresses of all blocks of the cache, so accesses do not
+	// read the central handle table; the compactor refreshes them.
+	ptrs map[Handle]unsafe.Pointer
+}
+
+func NewConcurrentArena(size int, options ...ArenaOption) (*ConcurrentArena, error) {
+	arena, err := NewArena(size, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &ConcurrentArena{arena: arena, caches: make(map[*LocalCache]struct{})}, nil
+}
+
+func (ca *ConcurrentArena) NewCache() *LocalCache {
+	cache := &LocalCache{
+		central: ca,
+		free:    make([][]Handle, len(sizeClasses)),
+		cached:  make(map[Handle]struct{}),
+		classes: make(map[Handle]int),
+		ptrs:    make(map[Handle]unsafe.Pointer),
+	}
+	ca.mu.Lock()
+	ca.caches[cache] = struct{}{}
+	ca.mu.Unlock()
+	return cache
+}
+
+func (ca *ConcurrentArena) Compact() (CompactStats, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.compactLocked()
+}
+
+func (ca *ConcurrentArena) compactLocked() (CompactStats, error) {
+	ca.stopping.Store(true)
+	defer ca.stopping.Store(false)
+	for cache := range ca.caches {
+		for cache.inFlight.Load() {
+			runtime.Gosched()
+		}
+	}
+
+	stats, err := ca.arena.Compact()
+	if err != nil {
+		return stats, err
+	}
+	for cache := range ca.caches {
+		for handle := range cache.ptrs {
+			cache.ptrs[handle], _ = ca.arena.Resolve(handle)
+		}
+	}
+	return stats, nil
+}
+
+// allocLocked compacts with the world stopped instead of letting the arena
+// compact on its own while other goroutines use their blocks.
+func (ca *ConcurrentArena) allocLocked(size int) (Handle, unsafe.Pointer, error) {
+	slot, err := ca.arena.allocNoCompact(size, 1)
+	if errors.Is(err, ErrOutOfMemory) && ca.arena.compactionMayFit(size) {
+		if _, err = ca.compactLocked(); err != nil {
+			return 0, nil, err
+		}
+		slot, err = ca.arena.allocNoCompact(size, 1)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return makeHandle(slot, ca.arena.generations[slot]), ca.arena.pointers[slot], nil
+}
+
+func (c *LocalCache) enter() {
+	for {
+		c.inFlight.Store(true)
+		if !c.central.stopping.Load() {
+			return
+		}
+		c.inFlight.Store(false)
+		// the compactor holds mu until the world is restarted
+		c.central.mu.Lock()
+		c.central.mu.Unlock()
+	}
+}
+
+func (c *LocalCache) exit() {
+	c.inFlight.Store(false)
+}
+
+func (c *LocalCache) Alloc(size int) (Handle, error) {
+	class := classFor(max(size, 1))
+	if class < 0 {
+		return c.allocCentral(size, class)
+	}
+
+	c.enter()
+	if handle, ok := c.popFree(class); ok {
+		c.exit()
+		return handle, nil
+	}
+	c.exit()
+
+	if err := c.refill(class); err != nil {
+		return 0, err
+	}
+	c.enter()
+	defer c.exit()
+	handle, _ := c.popFree(class)
+	return handle, nil
+}
+
+func (c *LocalCache) Free(handle Handle) error {
+	c.enter()
+	class, ok := c.classes[handle]
+	if !ok {
+		c.exit()
+		return fmt.Errorf("%w: %#x does not belong to the cache", ErrInvalidHandle, uint64(handle))
+	}
+	if _, ok := c.cached[handle]; ok {
+		c.exit()
+		return fmt.Errorf("%w: %#x has already been freed", ErrInvalidHandle, uint64(handle))
+	}
+	if class >= 0 {
+		clear(unsafe.Slice((*byte)(c.ptrs[handle]), sizeClasses[class]))
+		c.pushFree(class, handle)
+		overflow := len(c.free[class]) > cacheLimit
+		c.exit()
+		if overflow {
+			return c.flush(class, cacheLimit/2)
+		}
+		return nil
+	}
+	c.exit()
+
+	c.central.mu.Lock()
+	defer c.central.mu.Unlock()
+	delete(c.classes, handle)
+	delete(c.ptrs, handle)
+	return c.central.arena.FreeHandle(handle)
+}
+
+// Access calls fn with the current address of the block; the block is not
+// moved while fn runs. fn must not keep the pointer.
+func (c *LocalCache) Access(handle Handle, fn func(ptr unsafe.Pointer)) error {
+	c.enter()
+	defer c.exit()
+	ptr, ok := c.ptrs[handle]
+	if !ok {
+		return fmt.Errorf("%w: %#x does not belong to the cache", ErrInvalidHandle, uint64(handle))
+	}
+	if _, ok := c.cached[handle]; ok {
+		return fmt.Errorf("%w: %#x has been freed", ErrInvalidHandle, uint64(handle))
+	}
+	fn(ptr)
+	return nil
+}
+
+// Close returns cached free blocks to the central arena.
+func (c *LocalCache) Close() error {
+	for class := range c.free {
+		if err := c.flush(class, len(c.free[class])); err != nil {
+			return err
+		}
+	}
+	c.central.mu.Lock()
+	delete(c.central.caches, c)
+	c.central.mu.Unlock()
+	return nil
+}
+
+func (c *LocalCache) popFree(class int) (Handle, bool) {
+	list := c.free[class]
+	if len(list) == 0 {
+		return 0, false
+	}
+	handle := list[len(list)-1]
+	c.free[class] = list[:len(list)-1]
+	delete(c.cached, handle)
+	return handle, true
+}
+
+// pushFree caches a free block. Cached blocks keep their entries in
+// classes and ptrs, cached tells them from the blocks in use.
+func (c *LocalCache) pushFree(class int, handle Handle) {
+	c.free[class] = append(c.free[class], handle)
+	c.cached[handle] = struct{}{}
+}
+
+func (c *LocalCache) allocCentral(size, class int) (Handle, error) {
+	c.central.mu.Lock()
+	defer c.central.mu.Unlock()
+	handle, ptr, err := c.central.allocLocked(size)
+	if err != nil {
+		return 0, err
+	}
+	c.classes[handle] = class
+	c.ptrs[handle] = ptr
+	return handle, nil
+}
+
+func (c *LocalCache) refill(class int) error {
+	c.central.mu.Lock()
+	defer c.central.mu.Unlock()
+	for i := range cacheBatch {
+		handle, ptr, err := c.central.allocLocked(sizeClasses[class])
+		if err != nil {
+			if i > 0 && errors.Is(err, ErrOutOfMemory) {
+				return nil
+			}
+			return err
+		}
+		c.pushFree(class, handle)
+		c.classes[handle] = class
+		c.ptrs[handle] = ptr
+	}
+	return nil
+}
+
+func (c *LocalCache) flush(class, count int) error {
+	c.central.mu.Lock()
+	defer c.central.mu.Unlock()
+	for range count {
+		handle, _ := c.popFree(class)
+		delete(c.classes, handle)
+		delete(c.ptrs, handle)
+		if err := c.central.arena.FreeHandle(handle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestLocalCache(t *testing.T) {
+	arena, err := NewConcurrentArena(4096)
+	assert.NoError(t, err)
+	cache := arena.NewCache()
+
+	first, err := cache.Alloc(10)
+	assert.NoError(t, err)
+	assert.Len(t, cache.free[1], cacheBatch-1)
+	assert.NoError(t, cache.Access(first, func(ptr unsafe.Pointer) {
+		*(*uint64)(ptr) = 7
+	}))
+
+	large, err := cache.Alloc(1500)
+	assert.NoError(t, err)
+	assert.Equal(t, -1, cache.classes[large])
+	assert.NoError(t, cache.Free(large))
+	_, err = cache.Alloc(5000)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+
+	assert.NoError(t, cache.Free(first))
+	again, err := cache.Alloc(16)
+	assert.NoError(t, err)
+	assert.Equal(t, first, again)
+	assert.NoError(t, cache.Access(again, func(ptr unsafe.Pointer) {
+		assert.Zero(t, *(*uint64)(ptr))
+	}))
+
+	other := arena.NewCache()
+	assert.ErrorIs(t, other.Free(again), ErrInvalidHandle)
+	assert.ErrorIs(t, other.Access(again, func(unsafe.Pointer) {}), ErrInvalidHandle)
+
+	assert.NoError(t, cache.Close())
+	assert.NoError(t, other.Close())
+	assert.Equal(t, 1, len(arena.arena.pointers)-len(arena.arena.freeSlots))
+}
+
+// go test -race -run ConcurrentArenaStress .
+func TestLocalCacheDoubleFree(t *testing.T) {
+	arena, err := NewConcurrentArena(4096)
+	assert.NoError(t, err)
+	cache := arena.NewCache()
+
+	handle, err := cache.Alloc(8)
+	assert.NoError(t, err)
+	assert.NoError(t, cache.Free(handle))
+	assert.ErrorIs(t, cache.Free(handle), ErrInvalidHandle)
+	assert.ErrorIs(t, cache.Access(handle, func(unsafe.Pointer) {}), ErrInvalidHandle)
+
+	// the block is cached once, so two allocations get two blocks
+	first, err := cache.Alloc(8)
+	assert.NoError(t, err)
+	second, err := cache.Alloc(8)
+	assert.NoError(t, err)
+	assert.Equal(t, handle, first)
+	assert.NotEqual(t, first, second)
+	assert.NoError(t, cache.Access(first, func(unsafe.Pointer) {}))
+	assert.NoError(t, cache.Close())
+}
+
+func TestConcurrentArenaStress(t *testing.T) {
+	arena, err := NewConcurrentArena(64 * 1024)
+	assert.NoError(t, err)
+
+	const workers = 8
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	errs := make(chan error, workers+1)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+				if _, err := arena.Compact(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}
+	}()
+
+	var workersWG sync.WaitGroup
+	for worker := range workers {
+		workersWG.Add(1)
+		go func() {
+			defer workersWG.Done()
+			errs <- stress(arena.NewCache(), byte(worker+1))
+		}()
+	}
+	workersWG.Wait()
+	close(stop)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+}
+
+func stress(cache *LocalCache, tag byte) error {
+	random := rand.New(rand.NewPCG(uint64(tag), 0))
+	type object struct {
+		handle Handle
+		size   int
+	}
+	var live []object
+
+	check := func(obj object) error {
+		var err error
+		accessErr := cache.Access(obj.handle, func(ptr unsafe.Pointer) {
+			for i, v := range unsafe.Slice((*byte)(ptr), obj.size) {
+				if v != tag {
+					err = fmt.Errorf("cache %d: byte %d of block is %#x", tag, i, v)
+					return
+				}
+			}
+		})
+		return errors.Join(accessErr, err)
+	}
+
+	for range 2000 {
+		if len(live) > 0 && (len(live) >= 32 || random.IntN(2) == 0) {
+			idx := random.IntN(len(live))
+			if err := check(live[idx]); err != nil {
+				return err
+			}
+			if err := cache.Free(live[idx].handle); err != nil {
+				return err
+			}
+			live[idx] = live[len(live)-1]
+			live = live[:len(live)-1]
+			continue
+		}
+
+		obj := object{size: 1 + random.IntN(200)}
+		handle, err := cache.Alloc(obj.size)
+		if err != nil {
+			return err
+		}
+		obj.handle = handle
+		if err := cache.Access(handle, func(ptr unsafe.Pointer) {
+			fill(unsafe.Slice((*byte)(ptr), obj.size), tag)
+		}); err != nil {
+			return err
+		}
+		live = append(live, obj)
+	}
+
+	for _, obj := range live {
+		if err := check(obj); err != nil {
+			return err
+		}
+	}
+	return cache.Close()
+}
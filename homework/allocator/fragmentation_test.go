@@ -0,0 +1,178 @@
+package main
+
+import (
+	"math/bits"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type FragmentationReport struct {
+	TotalBytes       int
+	FreeBytes        int
+	LargestFreeBlock int
+	FreeRuns         int
+	// ExternalFragmentation is 1 - LargestFreeBlock/FreeBytes: 0 when all free
+	// memory is one run, close to 1 when it is scattered in small pieces.
+	ExternalFragmentation float64
+	// Histogram counts free runs by power of two bucket: the run size is in
+	// [bucket, 2*bucket).
+	Histogram map[int]int
+}
+
+func analyzeFreeRuns(total int, runs []int) FragmentationReport {
+	report := FragmentationReport{
+		TotalBytes: total,
+		FreeRuns:   len(runs),
+		Histogram:  make(map[int]int),
+	}
+	for _, run := range runs {
+		report.FreeBytes += run
+		report.LargestFreeBlock = max(report.LargestFreeBlock, run)
+		report.Histogram[1<<(bits.Len(uint(run))-1)]++
+	}
+	if report.FreeBytes > 0 {
+		report.ExternalFragmentation = 1 - float64(report.LargestFreeBlock)/float64(report.FreeBytes)
+	}
+	return report
+}
+
+// AnalyzeBytes treats zero bytes as free memory, the layout used by Defragment.
+func AnalyzeBytes(memory []byte) FragmentationReport {
+	var runs []int
+	run := 0
+	for _, v := range memory {
+		if v == 0 {
+			run++
+			continue
+		}
+		if run > 0 {
+			runs = append(runs, run)
+		}
+		run = 0
+	}
+	if run > 0 {
+		runs = append(runs, run)
+	}
+	return analyzeFreeRuns(len(memory), runs)
+}
+
+// RenderBytes draws one character per byte: '#' used, '.' free.
+func RenderBytes(memory []byte, width int) string {
+	cells := make([]byte, len(memory))
+	for i, v := range memory {
+		cells[i] = '.'
+		if v != 0 {
+			cells[i] = '#'
+		}
+	}
+	return renderCells(cells, width)
+}
+
+// Fragmentation counts whole free blocks, headers included, because they
+// become usable memory once the block is merged or allocated.
+func (a *Arena) Fragmentation() FragmentationReport {
+	var runs []int
+	for _, block := range a.freeBlocks() {
+		runs = append(runs, block.size)
+	}
+	return analyzeFreeRuns(len(a.memory), runs)
+}
+
+// Render draws one character per 8 byte granule: 'H' header of an allocated
+// block, '#' its payload, '.' free block.
+func (a *Arena) Render(width int) string {
+	cells := make([]byte, 0, len(a.memory)/blockAlignment)
+	for offset := 0; offset < len(a.memory); {
+		header := readHeader(a.memory, offset)
+		granules := header.size / blockAlignment
+		if !header.allocated() {
+			cells = append(cells, strings.Repeat(".", granules)...)
+		} else {
+			cells = append(cells, 'H')
+			cells = append(cells, strings.Repeat("#", granules-1)...)
+		}
+		offset += header.size
+	}
+	return renderCells(cells, width)
+}
+
+func renderCells(cells []byte, width int) string {
+	var builder strings.Builder
+	for len(cells) > 0 {
+		line := cells[:min(width, len(cells))]
+		builder.Write(line)
+		builder.WriteByte('\n')
+		cells = cells[len(line):]
+	}
+	return builder.String()
+}
+
+func TestAnalyzeBytes(t *testing.T) {
+	var fragmentedMemory = []byte{
+		0xFF, 0x00, 0x00, 0x00,
+		0x00, 0xFF, 0x00, 0x00,
+		0x00, 0x00, 0xFF, 0x00,
+		0x00, 0x00, 0x00, 0xFF,
+	}
+	var fragmentedPointers = []unsafe.Pointer{
+		unsafe.Pointer(&fragmentedMemory[0]),
+		unsafe.Pointer(&fragmentedMemory[5]),
+		unsafe.Pointer(&fragmentedMemory[10]),
+		unsafe.Pointer(&fragmentedMemory[15]),
+	}
+
+	before := AnalyzeBytes(fragmentedMemory)
+	assert.InDelta(t, 2.0/3, before.ExternalFragmentation, 1e-9)
+	before.ExternalFragmentation = 0
+	assert.Equal(t, FragmentationReport{
+		TotalBytes:       16,
+		FreeBytes:        12,
+		LargestFreeBlock: 4,
+		FreeRuns:         3,
+		Histogram:        map[int]int{4: 3},
+	}, before)
+	assert.Equal(t, "#....#..\n..#....#\n", RenderBytes(fragmentedMemory, 8))
+
+	Defragment(fragmentedMemory, fragmentedPointers)
+
+	after := AnalyzeBytes(fragmentedMemory)
+	assert.Equal(t, FragmentationReport{
+		TotalBytes:       16,
+		FreeBytes:        12,
+		LargestFreeBlock: 12,
+		FreeRuns:         1,
+		Histogram:        map[int]int{8: 1},
+	}, after)
+	assert.Equal(t, "####............\n", RenderBytes(fragmentedMemory, 16))
+}
+
+func TestArenaFragmentation(t *testing.T) {
+	arena, err := NewArena(128)
+	assert.NoError(t, err)
+
+	var handles []Handle
+	for _, size := range []int{8, 8, 24, 8, 8} {
+		handle, err := arena.AllocHandle(size)
+		assert.NoError(t, err)
+		handles = append(handles, handle)
+	}
+	assert.NoError(t, arena.FreeHandle(handles[0]))
+	assert.NoError(t, arena.FreeHandle(handles[2]))
+
+	report := arena.Fragmentation()
+	assert.Equal(t, 3, report.FreeRuns)
+	assert.Equal(t, 80, report.FreeBytes)
+	assert.Equal(t, 32, report.LargestFreeBlock)
+	assert.Equal(t, map[int]int{16: 1, 32: 2}, report.Histogram)
+	assert.Equal(t, "..H#....\nH#H#....\n", arena.Render(8))
+
+	_, err = arena.Compact()
+	assert.NoError(t, err)
+	report = arena.Fragmentation()
+	assert.Equal(t, 1, report.FreeRuns)
+	assert.Zero(t, report.ExternalFragmentation)
+	assert.Equal(t, "H#H#H#..\n........\n", arena.Render(8))
+}
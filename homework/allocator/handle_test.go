@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var ErrInvalidHandle = errors.New("invalid handle")
+
+// Handle is a stable reference to an arena block: slot index in the low
+// 32 bits and slot generation in the high 32 bits, so a handle to a freed
+// block never resolves to the block that reused its slot.
+type Handle uint64
+
+func makeHandle(slot int, generation uint32) Handle {
+	return Handle(uint64(generation)<<32 | uint64(uint32(slot)))
+}
+
+func (h Handle) slot() int {
+	return int(uint32(h))
+}
+
+func (h Handle) generation() uint32 {
+	return uint32(h >> 32)
+}
+
+func (a *Arena) AllocHandle(size int) (Handle, error) {
+	return a.AllocHandleAligned(size, 1)
+}
+
+func (a *Arena) AllocHandleAligned(size, align int) (Handle, error) {
+	slot, err := a.alloc(size, align)
+	if err != nil {
+		return 0, err
+	}
+	return makeHandle(slot, a.generations[slot]), nil
+}
+
+// Resolve returns the current address of the block, it must be called
+// again after every compaction.
+func (a *Arena) Resolve(h Handle) (unsafe.Pointer, error) {
+	slot, err := a.lookup(h)
+	if err != nil {
+		return nil, err
+	}
+	return a.pointers[slot], nil
+}
+
+func (a *Arena) FreeHandle(h Handle) error {
+	slot, err := a.lookup(h)
+	if err != nil {
+		return a.diagnoseHandle(h, err)
+	}
+	return a.release(slot)
+}
+
+func (a *Arena) lookup(h Handle) (int, error) {
+	slot := h.slot()
+	if slot >= len(a.pointers) || a.pointers[slot] == nil || a.generations[slot] != h.generation() {
+		return 0, fmt.Errorf("%w: %#x", ErrInvalidHandle, uint64(h))
+	}
+	return slot, nil
+}
+
+func (a *Arena) takeSlot(ptr unsafe.Pointer, size int) int {
+	if a.sanitize {
+		delete(a.freed, uintptr(ptr))
+		delete(a.moved, uintptr(ptr))
+	}
+	if n := len(a.freeSlots); n > 0 {
+		slot := a.freeSlots[n-1]
+		a.freeSlots = a.freeSlots[:n-1]
+		a.pointers[slot] = ptr
+		a.sizes[slot] = size
+		return slot
+	}
+	a.pointers = append(a.pointers, ptr)
+	a.sizes = append(a.sizes, size)
+	a.generations = append(a.generations, 1)
+	return len(a.pointers) - 1
+}
+
+func (a *Arena) releaseSlot(slot int) {
+	a.pointers[slot] = nil
+	a.sizes[slot] = 0
+	a.generations[slot]++
+	a.freeSlots = append(a.freeSlots, slot)
+}
+
+func TestHandlesSurviveCompaction(t *testing.T) {
+	arena, err := NewArena(128)
+	assert.NoError(t, err)
+
+	var handles []Handle
+	for i := range 6 {
+		handle, err := arena.AllocHandle(8)
+		assert.NoError(t, err)
+		ptr, err := arena.Resolve(handle)
+		assert.NoError(t, err)
+		*(*uint64)(ptr) = uint64(i + 1)
+		handles = append(handles, handle)
+	}
+
+	for _, i := range []int{0, 2, 3} {
+		assert.NoError(t, arena.FreeHandle(handles[i]))
+	}
+	_, err = arena.Compact()
+	assert.NoError(t, err)
+
+	for idx, i := range []int{1, 4, 5} {
+		ptr, err := arena.Resolve(handles[i])
+		assert.NoError(t, err)
+		assert.Equal(t, unsafe.Pointer(&arena.memory[idx*16+headerSize]), ptr)
+		assert.Equal(t, uint64(i+1), *(*uint64)(ptr))
+	}
+}
+
+func TestStaleHandle(t *testing.T) {
+	arena, err := NewArena(64)
+	assert.NoError(t, err)
+
+	stale, err := arena.AllocHandle(8)
+	assert.NoError(t, err)
+	assert.NoError(t, arena.FreeHandle(stale))
+
+	fresh, err := arena.AllocHandle(8)
+	assert.NoError(t, err)
+	assert.Equal(t, stale.slot(), fresh.slot())
+
+	_, err = arena.Resolve(stale)
+	assert.ErrorIs(t, err, ErrInvalidHandle)
+	assert.ErrorIs(t, arena.FreeHandle(stale), ErrInvalidHandle)
+	_, err = arena.Resolve(0)
+	assert.ErrorIs(t, err, ErrInvalidHandle)
+}
@@ -10,17 +10,61 @@ import (
 
 // go test -v homework_test.go
 
+// Bitmap tracks which bytes of the memory are allocated, so liveness does
+// not depend on the stored values and zero bytes can be kept.
+type Bitmap []uint64
+
+func NewBitmap(size int) Bitmap {
+	return make(Bitmap, (size+63)/64)
+}
+
+func (b Bitmap) Set(i int) {
+	b[i/64] |= 1 << (i % 64)
+}
+
+func (b Bitmap) Clear(i int) {
+	b[i/64] &^= 1 << (i % 64)
+}
+
+func (b Bitmap) Test(i int) bool {
+	return b[i/64]&(1<<(i%64)) != 0
+}
+
+// Defragment treats every non-zero byte as an allocated object.
 func Defragment(memory []byte, pointers []unsafe.Pointer) {
+	live := NewBitmap(len(memory))
+	for k, v := range memory {
+		if v != 0 {
+			live.Set(k)
+		}
+	}
+	DefragmentLive(memory, live, pointers)
+}
+
+// DefragmentLive moves the bytes marked in live to the beginning of the
+// memory whatever their values are and updates live to the new layout.
+func DefragmentLive(memory []byte, live Bitmap, pointers []unsafe.Pointer) {
+	base := uintptr(unsafe.Pointer(unsafe.SliceData(memory)))
+	moved := make(map[uintptr]int, len(pointers))
 	pointIdx := 0
 	for k, v := range memory {
-		if v == 0 {
+		if !live.Test(k) {
 			continue
 		}
+		live.Clear(k)
 		memory[k] = 0
 		memory[pointIdx] = v
-		pointers[pointIdx] = unsafe.Pointer(&memory[pointIdx])
+		live.Set(pointIdx)
+		moved[base+uintptr(k)] = pointIdx
 		pointIdx++
 	}
+	clear(memory[pointIdx:])
+
+	for i, ptr := range pointers {
+		if idx, ok := moved[uintptr(ptr)]; ok {
+			pointers[i] = unsafe.Pointer(&memory[idx])
+		}
+	}
 }
 
 func TestDefragmentation(t *testing.T) {
@@ -56,3 +100,43 @@ func TestDefragmentation(t *testing.T) {
 	assert.True(t, reflect.DeepEqual(defragmentedMemory, fragmentedMemory))
 	assert.True(t, reflect.DeepEqual(defragmentedPointers, fragmentedPointers))
 }
+
+func TestDefragmentationUnsortedPointers(t *testing.T) {
+	var memory = []byte{0x00, 0x11, 0x00, 0x22, 0x00, 0x33}
+
+	var pointers = []unsafe.Pointer{
+		unsafe.Pointer(&memory[5]),
+		unsafe.Pointer(&memory[1]),
+		unsafe.Pointer(&memory[3]),
+	}
+
+	Defragment(memory, pointers)
+	assert.Equal(t, []byte{0x11, 0x22, 0x33, 0x00, 0x00, 0x00}, memory)
+	assert.Equal(t, []unsafe.Pointer{
+		unsafe.Pointer(&memory[2]),
+		unsafe.Pointer(&memory[0]),
+		unsafe.Pointer(&memory[1]),
+	}, pointers)
+}
+
+func TestDefragmentationWithZeroBytes(t *testing.T) {
+	var memory = []byte{0x7F, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}
+
+	live := NewBitmap(len(memory))
+	for _, k := range []int{0, 2, 4, 5} {
+		live.Set(k)
+	}
+
+	var pointers = []unsafe.Pointer{
+		unsafe.Pointer(&memory[2]),
+		unsafe.Pointer(&memory[5]),
+	}
+
+	DefragmentLive(memory, live, pointers)
+	assert.Equal(t, []byte{0x7F, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00}, memory)
+	assert.Equal(t, Bitmap{0b1111}, live)
+	assert.Equal(t, []unsafe.Pointer{
+		unsafe.Pointer(&memory[1]),
+		unsafe.Pointer(&memory[3]),
+	}, pointers)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Budget limits the work of one Defragmenter step, zero means no limit.
+// A step always moves at least one block, otherwise a block larger than
+// the byte budget would never move.
+type Budget struct {
+	Bytes   int
+	Objects int
+}
+
+// Defragmenter compacts the arena a few blocks at a time. Everything before
+// the cursor is already compacted; after every move the block layout and
+// the handle table are consistent, so the arena can be used between steps.
+type Defragmenter struct {
+	arena  *Arena
+	cursor int
+}
+
+func NewDefragmenter(arena *Arena) *Defragmenter {
+	return &Defragmenter{arena: arena}
+}
+
+// Step moves blocks until the budget is spent and reports whether the pass
+// has reached the end of the arena. The next call after that starts a new pass.
+func (d *Defragmenter) Step(budget Budget) (bool, error) {
+	before := d.arena.snapshot()
+	done, err := d.step(budget)
+	d.arena.afterMove(before)
+	return done, err
+}
+
+func (d *Defragmenter) step(budget Budget) (bool, error) {
+	memory := d.arena.memory
+	if err := validateBlocks(memory); err != nil {
+		return false, err
+	}
+	d.resync()
+
+	var movedBytes, movedObjects int
+	for d.cursor < len(memory) {
+		header := readHeader(memory, d.cursor)
+		if header.allocated() {
+			d.cursor += header.size
+			continue
+		}
+
+		next := d.cursor + header.size
+		if next == len(memory) {
+			break
+		}
+		nextHeader := readHeader(memory, next)
+		if !nextHeader.allocated() {
+			clear(memory[next : next+headerSize])
+			writeHeader(memory, d.cursor, blockHeader{size: header.size + nextHeader.size})
+			continue
+		}
+
+		target := d.cursor + payloadPadding(memory, d.cursor+nextHeader.payloadOffset(), nextHeader.alignment())
+		if target >= next {
+			// the free block is the padding the next block needs
+			d.cursor = next + nextHeader.size
+			continue
+		}
+
+		if movedObjects > 0 && (budget.Objects > 0 && movedObjects >= budget.Objects ||
+			budget.Bytes > 0 && movedBytes+nextHeader.size > budget.Bytes) {
+			return false, nil
+		}
+
+		if target > d.cursor {
+			writeHeader(memory, d.cursor, blockHeader{size: target - d.cursor})
+		}
+		copy(memory[target:], memory[next:next+nextHeader.size])
+		free := target + nextHeader.size
+		clear(memory[free : next+nextHeader.size])
+		writeHeader(memory, free, blockHeader{size: next - target})
+		relocatePointers(memory, []blockMove{{from: next, to: target, size: nextHeader.size}}, d.arena.pointers)
+
+		d.cursor = free
+		movedBytes += nextHeader.size
+		movedObjects++
+	}
+
+	d.cursor = 0
+	return true, nil
+}
+
+// resync moves the cursor back to a block boundary: frees between steps may
+// have merged the block at the cursor with a free block before it.
+func (d *Defragmenter) resync() {
+	memory := d.arena.memory
+	offset := 0
+	for offset < len(memory) {
+		size := readHeader(memory, offset).size
+		if offset+size > d.cursor {
+			break
+		}
+		offset += size
+	}
+	d.cursor = offset
+}
+
+func TestDefragmenterSteps(t *testing.T) {
+	arena, err := NewArena(128)
+	assert.NoError(t, err)
+
+	var handles []Handle
+	for i := range 6 {
+		handle, err := arena.AllocHandle(8)
+		assert.NoError(t, err)
+		ptr, err := arena.Resolve(handle)
+		assert.NoError(t, err)
+		*(*uint64)(ptr) = uint64(i + 1)
+		handles = append(handles, handle)
+	}
+	for _, i := range []int{0, 2, 4} {
+		assert.NoError(t, arena.FreeHandle(handles[i]))
+	}
+	assert.Equal(t, "..H#..H#\n..H#....\n", arena.Render(8))
+
+	defragmenter := NewDefragmenter(arena)
+	steps := []struct {
+		render string
+		done   bool
+	}{
+		{render: "H#....H#\n..H#....\n"},
+		{render: "H#H#....\n..H#....\n"},
+		{render: "H#H#H#..\n........\n", done: true},
+	}
+	for _, step := range steps {
+		done, err := defragmenter.Step(Budget{Objects: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, step.done, done)
+		assert.Equal(t, step.render, arena.Render(8))
+		assert.NoError(t, validateBlocks(arena.memory))
+
+		for _, i := range []int{1, 3, 5} {
+			ptr, err := arena.Resolve(handles[i])
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(i+1), *(*uint64)(ptr))
+		}
+	}
+	assert.Equal(t, 1, arena.Fragmentation().FreeRuns)
+}
+
+func TestDefragmenterInterleavedWithFree(t *testing.T) {
+	arena, err := NewArena(128)
+	assert.NoError(t, err)
+
+	var handles []Handle
+	for range 8 {
+		handle, err := arena.AllocHandle(8)
+		assert.NoError(t, err)
+		handles = append(handles, handle)
+	}
+	assert.NoError(t, arena.FreeHandle(handles[1]))
+
+	defragmenter := NewDefragmenter(arena)
+	done, err := defragmenter.Step(Budget{Bytes: 16})
+	assert.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, "H#H#..H#\nH#H#H#H#\n", arena.Render(8))
+
+	// the block right before the cursor is freed and merged with the free one at the cursor
+	ptr, err := arena.Resolve(handles[2])
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&arena.memory[16+headerSize]), ptr)
+	assert.NoError(t, arena.FreeHandle(handles[2]))
+
+	for !done {
+		done, err = defragmenter.Step(Budget{Bytes: 16})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, "H#H#H#H#\nH#H#....\n", arena.Render(8))
+}
@@ -0,0 +1,332 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// File layout of a persistent arena:
+//
+//	[file header 64][arena memory][handle table]
+//
+// The file header holds the magic, the format version, the arena size, the
+// number of used handle table entries and a CRC-32 of the memory and the
+// used entries. Every entry is 16 bytes: payload offset (0 for a free
+// slot), requested size, generation and an unused word. A live block takes
+// at least 16 bytes, so the table never needs more than size/16 entries.
+//
+// The header is only rewritten by Sync and Close; a file left by a process
+// that died in between fails the checksum.
+
+const (
+	fileHeaderSize    = 64
+	fileVersion       = 1
+	tableEntrySize    = 16
+	minLiveBlockSize  = 16
+	fileChecksumField = 24
+)
+
+var (
+	ErrCorruptedFile = errors.New("corrupted arena file")
+
+	fileMagic = []byte("PAR1")
+)
+
+// PersistentArena is an Arena whose memory is a shared mapping of a file,
+// so live blocks and their handles survive a restart. Raw pointers are
+// only valid until Close.
+type PersistentArena struct {
+	*Arena
+	file *os.File
+	data []byte
+}
+
+func CreatePersistent(path string, size int, options ...ArenaOption) (*PersistentArena, error) {
+	size = alignUp(size, blockAlignment)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	// a half created file would fail OpenPersistent and block the next
+	// CreatePersistent, so it is removed on every error
+	if err := file.Truncate(int64(fileSize(size))); err != nil {
+		return nil, errors.Join(err, file.Close(), os.Remove(path))
+	}
+	p, err := mapArena(file, fileSize(size))
+	if err != nil {
+		return nil, errors.Join(err, os.Remove(path))
+	}
+	memory := p.data[fileHeaderSize : fileHeaderSize+size : fileHeaderSize+size]
+	if err := FormatBlocks(memory); err != nil {
+		return nil, errors.Join(err, p.unmap(), os.Remove(path))
+	}
+	p.Arena = newArena(memory, options)
+	if err := p.Sync(); err != nil {
+		return nil, errors.Join(err, p.unmap(), os.Remove(path))
+	}
+	return p, nil
+}
+
+func OpenPersistent(path string, options ...ArenaOption) (*PersistentArena, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+	if info.Size() < fileHeaderSize {
+		return nil, errors.Join(fmt.Errorf("%w: file is too short", ErrCorruptedFile), file.Close())
+	}
+	p, err := mapArena(file, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	if err := p.restore(options); err != nil {
+		return nil, errors.Join(err, p.unmap())
+	}
+	return p, nil
+}
+
+func fileSize(size int) int {
+	return fileHeaderSize + size + size/minLiveBlockSize*tableEntrySize
+}
+
+func mapArena(file *os.File, size int) (*PersistentArena, error) {
+	data, err := syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("mmap %s: %w", file.Name(), err), file.Close())
+	}
+	return &PersistentArena{file: file, data: data}, nil
+}
+
+func (p *PersistentArena) restore(options []ArenaOption) error {
+	if !bytes.Equal(p.data[:len(fileMagic)], fileMagic) {
+		return fmt.Errorf("%w: bad magic", ErrCorruptedFile)
+	}
+	if version := binary.LittleEndian.Uint32(p.data[4:]); version != fileVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrCorruptedFile, version)
+	}
+	size := binary.LittleEndian.Uint64(p.data[8:])
+	slots := binary.LittleEndian.Uint64(p.data[16:])
+	if size%blockAlignment != 0 || size > uint64(len(p.data)) || fileSize(int(size)) != len(p.data) {
+		return fmt.Errorf("%w: arena size %d does not match file size %d", ErrCorruptedFile, size, len(p.data))
+	}
+	if slots > size/minLiveBlockSize {
+		return fmt.Errorf("%w: %d handle table entries", ErrCorruptedFile, slots)
+	}
+	if sum := p.checksum(int(size), int(slots)); sum != binary.LittleEndian.Uint32(p.data[fileChecksumField:]) {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorruptedFile)
+	}
+
+	memory := p.data[fileHeaderSize : fileHeaderSize+size : fileHeaderSize+size]
+	if err := validateBlocks(memory); err != nil {
+		return fmt.Errorf("%w: %w", ErrCorruptedFile, err)
+	}
+	payloads := make(map[int]bool)
+	for offset := 0; offset < len(memory); {
+		header := readHeader(memory, offset)
+		if header.allocated() {
+			payloads[offset+header.payloadOffset()] = false
+		}
+		offset += header.size
+	}
+
+	arena := newArena(memory, nil)
+	table := p.data[fileHeaderSize+int(size):]
+	for slot := range int(slots) {
+		entry := table[slot*tableEntrySize:]
+		payload := int(binary.LittleEndian.Uint32(entry))
+		requested := int(binary.LittleEndian.Uint32(entry[4:]))
+		generation := binary.LittleEndian.Uint32(entry[8:])
+
+		var ptr unsafe.Pointer
+		if payload == 0 {
+			arena.freeSlots = append(arena.freeSlots, slot)
+		} else {
+			if used, ok := payloads[payload]; !ok || used {
+				return fmt.Errorf("%w: slot %d refers to offset %d, which is not a block", ErrCorruptedFile, slot, payload)
+			}
+			payloads[payload] = true
+			ptr = unsafe.Pointer(&memory[payload])
+		}
+		arena.pointers = append(arena.pointers, ptr)
+		arena.sizes = append(arena.sizes, requested)
+		arena.generations = append(arena.generations, generation)
+	}
+	if live := len(arena.pointers) - len(arena.freeSlots); live != len(payloads) {
+		return fmt.Errorf("%w: %d allocated blocks but %d live handles", ErrCorruptedFile, len(payloads), live)
+	}
+
+	for _, opt := range options {
+		opt(arena)
+	}
+	p.Arena = arena
+	return nil
+}
+
+// Sync writes the handle table and the file header and flushes the
+// mapping to the file.
+func (p *PersistentArena) Sync() error {
+	size := len(p.memory)
+	if len(p.pointers) > size/minLiveBlockSize {
+		return fmt.Errorf("handle table has %d entries, the file has room for %d", len(p.pointers), size/minLiveBlockSize)
+	}
+	table := p.data[fileHeaderSize+size:]
+	base := uintptr(unsafe.Pointer(unsafe.SliceData(p.memory)))
+	for slot, ptr := range p.pointers {
+		entry := table[slot*tableEntrySize : (slot+1)*tableEntrySize]
+		var payload uint32
+		if ptr != nil {
+			payload = uint32(uintptr(ptr) - base)
+		}
+		binary.LittleEndian.PutUint32(entry, payload)
+		binary.LittleEndian.PutUint32(entry[4:], uint32(p.sizes[slot]))
+		binary.LittleEndian.PutUint32(entry[8:], p.generations[slot])
+		binary.LittleEndian.PutUint32(entry[12:], 0)
+	}
+
+	header := p.data[:fileHeaderSize]
+	clear(header)
+	copy(header, fileMagic)
+	binary.LittleEndian.PutUint32(header[4:], fileVersion)
+	binary.LittleEndian.PutUint64(header[8:], uint64(size))
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(p.pointers)))
+	binary.LittleEndian.PutUint32(header[fileChecksumField:], p.checksum(size, len(p.pointers)))
+
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(unsafe.SliceData(p.data))), uintptr(len(p.data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return fmt.Errorf("msync %s: %w", p.file.Name(), errno)
+	}
+	return nil
+}
+
+// Close syncs and unmaps the file. The arena must not be used afterwards.
+func (p *PersistentArena) Close() error {
+	if err := p.Sync(); err != nil {
+		return errors.Join(err, p.unmap())
+	}
+	return p.unmap()
+}
+
+func (p *PersistentArena) checksum(size, slots int) uint32 {
+	return crc32.ChecksumIEEE(p.data[fileHeaderSize : fileHeaderSize+size+slots*tableEntrySize])
+}
+
+func (p *PersistentArena) unmap() error {
+	err := syscall.Munmap(p.data)
+	p.data = nil
+	return errors.Join(err, p.file.Close())
+}
+
+func TestPersistentArenaReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "arena")
+	arena, err := CreatePersistent(path, 128)
+	assert.NoError(t, err)
+	assert.Zero(t, uintptr(unsafe.Pointer(&arena.memory[0]))%maxAlignment)
+
+	var handles []Handle
+	for i := range 4 {
+		handle, err := arena.AllocHandleAligned(8, 8)
+		assert.NoError(t, err)
+		ptr, err := arena.Resolve(handle)
+		assert.NoError(t, err)
+		*(*uint64)(ptr) = uint64(i + 1)
+		handles = append(handles, handle)
+	}
+	assert.NoError(t, arena.FreeHandle(handles[0]))
+	assert.NoError(t, arena.FreeHandle(handles[2]))
+	stats, err := arena.Compact()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.MovedBlocks)
+	assert.NoError(t, arena.Close())
+
+	_, err = CreatePersistent(path, 128)
+	assert.ErrorIs(t, err, os.ErrExist)
+	_, err = CreatePersistent(path+".bad", -64)
+	assert.Error(t, err)
+	assert.NoFileExists(t, path+".bad")
+
+	arena, err = OpenPersistent(path)
+	assert.NoError(t, err)
+	for idx, i := range []int{1, 3} {
+		ptr, err := arena.Resolve(handles[i])
+		assert.NoError(t, err)
+		assert.Equal(t, unsafe.Pointer(&arena.memory[idx*16+headerSize]), ptr)
+		assert.Equal(t, uint64(i+1), *(*uint64)(ptr))
+	}
+	_, err = arena.Resolve(handles[0])
+	assert.ErrorIs(t, err, ErrInvalidHandle)
+
+	fresh, err := arena.AllocHandle(8)
+	assert.NoError(t, err)
+	assert.NotEqual(t, handles[0], fresh)
+	assert.NotEqual(t, handles[2], fresh)
+	assert.NoError(t, arena.Close())
+
+	arena, err = OpenPersistent(path)
+	assert.NoError(t, err)
+	_, err = arena.Resolve(fresh)
+	assert.NoError(t, err)
+	assert.NoError(t, arena.Close())
+}
+
+func TestPersistentArenaChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "arena")
+	arena, err := CreatePersistent(path, 64)
+	assert.NoError(t, err)
+	_, err = arena.AllocHandle(8)
+	assert.NoError(t, err)
+	assert.NoError(t, arena.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	data[fileHeaderSize+headerSize] ^= 0xFF
+	assert.NoError(t, os.WriteFile(path, data, 0o644))
+	_, err = OpenPersistent(path)
+	assert.ErrorIs(t, err, ErrCorruptedFile)
+
+	assert.NoError(t, os.WriteFile(path, []byte("PAR1"), 0o644))
+	_, err = OpenPersistent(path)
+	assert.ErrorIs(t, err, ErrCorruptedFile)
+}
+
+func TestPersistentArenaSanitizerMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "arena")
+	arena, err := CreatePersistent(path, 256, WithSanitizer())
+	assert.NoError(t, err)
+	zoned, err := arena.AllocHandle(8)
+	assert.NoError(t, err)
+	assert.NoError(t, arena.Close())
+
+	// blocks with red zones are freed by an arena without the sanitizer
+	arena, err = OpenPersistent(path)
+	assert.NoError(t, err)
+	plain, err := arena.AllocHandle(8)
+	assert.NoError(t, err)
+	assert.NoError(t, arena.FreeHandle(zoned))
+	assert.NoError(t, arena.Close())
+
+	// and blocks without them by an arena with the sanitizer
+	arena, err = OpenPersistent(path, WithSanitizer())
+	assert.NoError(t, err)
+	ptr, err := arena.Resolve(plain)
+	assert.NoError(t, err)
+	assert.NoError(t, arena.CheckPointer(ptr))
+	assert.NoError(t, arena.FreeHandle(plain))
+	assert.Empty(t, arena.Check())
+	assert.NoError(t, arena.Close())
+}
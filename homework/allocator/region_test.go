@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var ErrBadMark = errors.New("mark does not belong to the region")
+
+// Region is a bump pointer allocator: Alloc only moves the top, and
+// Reset drops everything allocated after a mark in O(1). Memory is zeroed
+// when it is handed out again, not when it is released.
+type Region struct {
+	memory []byte
+	top    int
+	// child is the nested region currently carved out of the free space.
+	child  *Region
+	parent *Region
+}
+
+// Mark is a saved position of the region top.
+type Mark struct {
+	region *Region
+	top    int
+}
+
+func NewRegion(memory []byte) *Region {
+	return &Region{memory: memory}
+}
+
+func (r *Region) Alloc(size, align int) (unsafe.Pointer, error) {
+	if r.child != nil {
+		return nil, errors.New("region has an open nested region")
+	}
+	if size < 0 || !isPowerOfTwo(align) {
+		return nil, fmt.Errorf("invalid size %d or alignment %d", size, align)
+	}
+	base := uintptr(unsafe.Pointer(unsafe.SliceData(r.memory)))
+	start := int(uintptr(alignUp(int(base)+r.top, align)) - base)
+	if size > len(r.memory)-start {
+		return nil, fmt.Errorf("%w: requested %d bytes", ErrOutOfMemory, size)
+	}
+	r.top = start + size
+	clear(r.memory[start:r.top])
+	return unsafe.Pointer(unsafe.SliceData(r.memory[start:])), nil
+}
+
+func (r *Region) Mark() Mark {
+	return Mark{region: r, top: r.top}
+}
+
+// Reset releases every allocation made after the mark and closes nested
+// regions opened after it.
+func (r *Region) Reset(mark Mark) error {
+	if mark.region != r || mark.top > r.top {
+		return ErrBadMark
+	}
+	if r.child != nil {
+		if r.top-len(r.child.memory) < mark.top {
+			return fmt.Errorf("%w: nested region opened before the mark is still open", ErrBadMark)
+		}
+		r.child.detach()
+	}
+	r.top = mark.top
+	return nil
+}
+
+// Nested opens a child region over the free space of r. The parent cannot
+// allocate until the child is closed, and resetting the parent closes it.
+func (r *Region) Nested(size int) (*Region, error) {
+	if r.child != nil {
+		return nil, errors.New("region has an open nested region")
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("invalid size %d", size)
+	}
+	if size > len(r.memory)-r.top {
+		return nil, fmt.Errorf("%w: requested %d bytes", ErrOutOfMemory, size)
+	}
+	child := &Region{memory: r.memory[r.top : r.top+size : r.top+size], parent: r}
+	r.child = child
+	r.top += size
+	return child, nil
+}
+
+// Close releases the nested region and gives its space back to the parent.
+func (r *Region) Close() error {
+	if r.parent == nil {
+		return errors.New("region is not nested")
+	}
+	parent := r.parent
+	r.detach()
+	parent.top -= len(r.memory)
+	return nil
+}
+
+func (r *Region) detach() {
+	if r.child != nil {
+		r.child.detach()
+	}
+	if r.parent != nil {
+		r.parent.child = nil
+		r.parent = nil
+	}
+	r.top = len(r.memory)
+}
+
+func (r *Region) Used() int {
+	return r.top
+}
+
+func TestRegionMarkAndReset(t *testing.T) {
+	memory := make([]byte, 64)
+	region := NewRegion(memory)
+
+	first, err := region.Alloc(3, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[0]), first)
+
+	mark := region.Mark()
+	second, err := region.Alloc(8, 8)
+	assert.NoError(t, err)
+	assert.Zero(t, uintptr(second)%8)
+	*(*uint64)(second) = 42
+	_, err = region.Alloc(40, 1)
+	assert.NoError(t, err)
+	_, err = region.Alloc(16, 1)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	_, err = region.Alloc(math.MaxInt, 1)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+
+	assert.NoError(t, region.Reset(mark))
+	assert.Equal(t, 3, region.Used())
+	again, err := region.Alloc(8, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, second, again)
+	assert.Zero(t, *(*uint64)(again))
+
+	assert.ErrorIs(t, region.Reset(Mark{region: region, top: 60}), ErrBadMark)
+	assert.ErrorIs(t, region.Reset(NewRegion(memory).Mark()), ErrBadMark)
+}
+
+func TestNestedRegion(t *testing.T) {
+	memory := make([]byte, 64)
+	parent := NewRegion(memory)
+	_, err := parent.Alloc(8, 1)
+	assert.NoError(t, err)
+	mark := parent.Mark()
+
+	_, err = parent.Nested(-8)
+	assert.Error(t, err)
+	_, err = parent.Nested(math.MaxInt)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	child, err := parent.Nested(32)
+	assert.NoError(t, err)
+	assert.Equal(t, 40, parent.Used())
+	_, err = parent.Alloc(1, 1)
+	assert.Error(t, err)
+
+	ptr, err := child.Alloc(16, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[8]), ptr)
+	grandchild, err := child.Nested(8)
+	assert.NoError(t, err)
+	_, err = grandchild.Alloc(8, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, grandchild.Close())
+	assert.Equal(t, 16, child.Used())
+
+	assert.NoError(t, child.Close())
+	assert.Equal(t, 8, parent.Used())
+	assert.Error(t, child.Close())
+
+	child, err = parent.Nested(16)
+	assert.NoError(t, err)
+	assert.NoError(t, parent.Reset(mark))
+	_, err = child.Alloc(1, 1)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	_, err = parent.Alloc(1, 1)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// In sanitizer mode every allocated block looks like
+// [header][red zone 8][payload][red zone up to the block end]
+// and payloads of free blocks are filled with poison, so stray writes
+// can be found by Check and stale pointers are reported by CheckPointer.
+
+const (
+	redZoneSize = 8
+	redZoneByte = 0xFA
+	poisonByte  = 0xDD
+)
+
+var (
+	ErrDoubleFree    = errors.New("double free")
+	ErrUseAfterFree  = errors.New("use after free")
+	ErrUseAfterMove  = errors.New("use after move")
+	ErrCorruptedZone = errors.New("corrupted red zone")
+)
+
+func WithSanitizer() ArenaOption {
+	return func(a *Arena) {
+		a.sanitize = true
+		a.freed = make(map[uintptr]struct{})
+		a.moved = make(map[uintptr]uintptr)
+		a.poisonFree()
+	}
+}
+
+type Corruption struct {
+	Block  int
+	Offset int
+	Reason string
+}
+
+func (c Corruption) Error() string {
+	return fmt.Sprintf("%v: %s at offset %d of block %d", ErrCorruptedZone, c.Reason, c.Offset, c.Block)
+}
+
+func (c Corruption) Unwrap() error {
+	return ErrCorruptedZone
+}
+
+// Check reports every byte of a red zone or of freed memory that has been
+// overwritten. It only finds anything in sanitizer mode.
+func (a *Arena) Check() []Corruption {
+	if !a.sanitize {
+		return nil
+	}
+	sizes := make(map[unsafe.Pointer]int, len(a.pointers))
+	for slot, ptr := range a.pointers {
+		if ptr != nil {
+			sizes[ptr] = a.sizes[slot]
+		}
+	}
+
+	var corruptions []Corruption
+	report := func(block, from, to int, expected byte, reason string) {
+		for i := from; i < to; i++ {
+			if a.memory[i] != expected {
+				corruptions = append(corruptions, Corruption{Block: block, Offset: i, Reason: reason})
+				return
+			}
+		}
+	}
+	for offset := 0; offset < len(a.memory); {
+		header := readHeader(a.memory, offset)
+		end := offset + header.size
+		switch {
+		case !header.allocated():
+			report(offset, offset+headerSize, end, poisonByte, "write to freed memory")
+		case header.flags&flagRedZones != 0:
+			payload := offset + header.payloadOffset()
+			size := sizes[unsafe.Pointer(&a.memory[payload])]
+			report(offset, offset+headerSize, payload, redZoneByte, "buffer underflow")
+			report(offset, payload+size, end, redZoneByte, "buffer overflow")
+		}
+		offset = end
+	}
+	return corruptions
+}
+
+// CheckPointer tells whether a raw pointer still refers to a live block
+// and, in sanitizer mode, why it does not.
+func (a *Arena) CheckPointer(ptr unsafe.Pointer) error {
+	if ptr != nil && slices.Contains(a.pointers, ptr) {
+		return nil
+	}
+	return a.diagnosePointer(ptr, ErrUseAfterFree, fmt.Errorf("%w: %p is not an allocated block", ErrInvalidPointer, ptr))
+}
+
+// diagnosePointer replaces err by a more precise one for pointers the
+// sanitizer knows about: freedErr for freed blocks, ErrUseAfterMove for
+// blocks moved by compaction.
+func (a *Arena) diagnosePointer(ptr unsafe.Pointer, freedErr, err error) error {
+	if !a.sanitize {
+		return err
+	}
+	if to, ok := a.moved[uintptr(ptr)]; ok {
+		return fmt.Errorf("%w: block %p has been moved to %#x", ErrUseAfterMove, ptr, to)
+	}
+	if _, ok := a.freed[uintptr(ptr)]; ok {
+		return fmt.Errorf("%w: block %p has already been freed", freedErr, ptr)
+	}
+	return err
+}
+
+func (a *Arena) diagnoseHandle(h Handle, err error) error {
+	if !a.sanitize {
+		return err
+	}
+	slot := h.slot()
+	if slot < len(a.pointers) && a.pointers[slot] == nil && a.generations[slot] == h.generation()+1 {
+		return fmt.Errorf("%w: handle %#x has already been freed", ErrDoubleFree, uint64(h))
+	}
+	return err
+}
+
+func (a *Arena) paintRedZones(offset, size int) {
+	header := readHeader(a.memory, offset)
+	payload := offset + header.payloadOffset()
+	fill(a.memory[offset+headerSize:payload], redZoneByte)
+	clear(a.memory[payload : payload+size])
+	fill(a.memory[payload+size:offset+header.size], redZoneByte)
+}
+
+func (a *Arena) poisonFree() {
+	for _, block := range a.freeBlocks() {
+		fill(a.memory[block.offset+headerSize:block.offset+block.size], poisonByte)
+	}
+}
+
+// snapshot and afterMove record where moved blocks went, so stale
+// pointers can be reported as use after move.
+func (a *Arena) snapshot() []unsafe.Pointer {
+	if !a.sanitize {
+		return nil
+	}
+	return slices.Clone(a.pointers)
+}
+
+func (a *Arena) afterMove(before []unsafe.Pointer) {
+	if !a.sanitize {
+		return
+	}
+	for slot, from := range before {
+		if to := a.pointers[slot]; from != nil && to != from {
+			a.moved[uintptr(from)] = uintptr(to)
+		}
+	}
+	a.poisonFree()
+}
+
+func fill(memory []byte, value byte) {
+	for i := range memory {
+		memory[i] = value
+	}
+}
+
+func TestSanitizerRedZones(t *testing.T) {
+	arena, err := NewArena(128, WithSanitizer())
+	assert.NoError(t, err)
+
+	ptr, err := arena.Alloc(5)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&arena.memory[headerSize+redZoneSize]), ptr)
+	assert.Empty(t, arena.Check())
+
+	payload := unsafe.Slice((*byte)(ptr), 6)
+	copy(payload, "hello!")
+	assert.Equal(t, []Corruption{{Block: 0, Offset: 21, Reason: "buffer overflow"}}, arena.Check())
+	payload[5] = redZoneByte
+
+	*(*byte)(unsafe.Add(ptr, -1)) = 0
+	assert.Equal(t, []Corruption{{Block: 0, Offset: 15, Reason: "buffer underflow"}}, arena.Check())
+	*(*byte)(unsafe.Add(ptr, -1)) = redZoneByte
+
+	assert.NoError(t, arena.Free(ptr))
+	assert.Equal(t, byte(poisonByte), arena.memory[headerSize+redZoneSize])
+	payload[0] = 'x'
+	corruptions := arena.Check()
+	assert.Equal(t, []Corruption{{Block: 0, Offset: 16, Reason: "write to freed memory"}}, corruptions)
+	assert.ErrorIs(t, corruptions[0], ErrCorruptedZone)
+}
+
+func TestSanitizerDoubleFree(t *testing.T) {
+	arena, err := NewArena(128, WithSanitizer())
+	assert.NoError(t, err)
+
+	ptr, err := arena.Alloc(8)
+	assert.NoError(t, err)
+	assert.NoError(t, arena.Free(ptr))
+	assert.ErrorIs(t, arena.Free(ptr), ErrDoubleFree)
+	assert.ErrorIs(t, arena.CheckPointer(ptr), ErrUseAfterFree)
+
+	handle, err := arena.AllocHandle(8)
+	assert.NoError(t, err)
+	assert.NoError(t, arena.FreeHandle(handle))
+	assert.ErrorIs(t, arena.FreeHandle(handle), ErrDoubleFree)
+}
+
+func TestSanitizerUseAfterMove(t *testing.T) {
+	arena, err := NewArena(128, WithSanitizer())
+	assert.NoError(t, err)
+
+	first, err := arena.Alloc(8)
+	assert.NoError(t, err)
+	second, err := arena.Alloc(8)
+	assert.NoError(t, err)
+	third, err := arena.Alloc(8)
+	assert.NoError(t, err)
+	assert.NoError(t, arena.Free(first))
+	assert.NoError(t, arena.Free(second))
+
+	_, err = arena.Compact()
+	assert.NoError(t, err)
+	assert.ErrorIs(t, arena.CheckPointer(third), ErrUseAfterMove)
+	assert.ErrorIs(t, arena.Free(third), ErrUseAfterMove)
+	assert.Equal(t, byte(poisonByte), *(*byte)(third))
+	assert.Empty(t, arena.Check())
+
+	moved := arena.pointers[slices.IndexFunc(arena.pointers, func(p unsafe.Pointer) bool { return p != nil })]
+	assert.NoError(t, arena.CheckPointer(moved))
+	assert.NoError(t, arena.Free(moved))
+}
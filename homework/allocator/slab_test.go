@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"slices"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Size classes follow the idea of runtime/sizeclasses.go: every request is
+// rounded up to the nearest class and served from a span that only holds
+// objects of that class.
+var sizeClasses = []int{8, 16, 32, 64, 128, 256, 512, 1024}
+
+type span struct {
+	offset    int
+	class     int
+	capacity  int
+	inUse     int
+	bitmap    []uint64
+	requested []int
+}
+
+func (s *span) objectSize() int {
+	return sizeClasses[s.class]
+}
+
+func (s *span) takeSlot() int {
+	for i, word := range s.bitmap {
+		if word == ^uint64(0) {
+			continue
+		}
+		slot := i*64 + bits.TrailingZeros64(^word)
+		if slot >= s.capacity {
+			break
+		}
+		s.bitmap[i] |= 1 << (slot % 64)
+		s.inUse++
+		return slot
+	}
+	return -1
+}
+
+func (s *span) allocated(slot int) bool {
+	return s.bitmap[slot/64]&(1<<(slot%64)) != 0
+}
+
+// Slab carves fixed size spans out of the memory. Like mcache it keeps the
+// current span for every class and asks for a new one only when it is full.
+type Slab struct {
+	memory   []byte
+	spanSize int
+	spans    []*span // indexed by offset / spanSize, nil for unused spans
+	current  []*span // per class
+}
+
+type ClassStats struct {
+	Size           int
+	Spans          int
+	ObjectsInUse   int
+	Capacity       int
+	RequestedBytes int
+}
+
+type SlabStats struct {
+	Classes    []ClassStats
+	SpansInUse int
+	SpansTotal int
+	// SpanUtilization is the share of bytes in used spans occupied by objects.
+	SpanUtilization float64
+	// InternalFragmentation is the share of object bytes lost to class rounding.
+	InternalFragmentation float64
+	// ExternalFragmentation is the share of bytes in used spans that hold no object.
+	ExternalFragmentation float64
+}
+
+func NewSlab(memory []byte, spanSize int) (*Slab, error) {
+	if spanSize < sizeClasses[len(sizeClasses)-1] || len(memory) < spanSize || len(memory)%spanSize != 0 {
+		return nil, fmt.Errorf("memory size %d must be a multiple of span size %d, which must fit the largest class", len(memory), spanSize)
+	}
+	return &Slab{
+		memory:   memory,
+		spanSize: spanSize,
+		spans:    make([]*span, len(memory)/spanSize),
+		current:  make([]*span, len(sizeClasses)),
+	}, nil
+}
+
+func classFor(size int) int {
+	for class, classSize := range sizeClasses {
+		if size <= classSize {
+			return class
+		}
+	}
+	return -1
+}
+
+func (s *Slab) Alloc(size int) (unsafe.Pointer, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("negative allocation size %d", size)
+	}
+	class := classFor(max(size, 1))
+	if class < 0 {
+		return nil, fmt.Errorf("size %d exceeds the largest size class %d", size, sizeClasses[len(sizeClasses)-1])
+	}
+
+	sp := s.current[class]
+	if sp == nil || sp.inUse == sp.capacity {
+		if sp = s.partialSpan(class); sp == nil {
+			if sp = s.newSpan(class); sp == nil {
+				return nil, fmt.Errorf("%w: no free span for %d bytes", ErrOutOfMemory, size)
+			}
+		}
+		s.current[class] = sp
+	}
+
+	slot := sp.takeSlot()
+	sp.requested[slot] = size
+	return unsafe.Pointer(&s.memory[sp.offset+slot*sp.objectSize()]), nil
+}
+
+func (s *Slab) Free(ptr unsafe.Pointer) error {
+	base := uintptr(unsafe.Pointer(unsafe.SliceData(s.memory)))
+	addr := uintptr(ptr)
+	if addr < base || addr >= base+uintptr(len(s.memory)) {
+		return fmt.Errorf("%w: %p is outside of the slab", ErrInvalidPointer, ptr)
+	}
+	offset := int(addr - base)
+	sp := s.spans[offset/s.spanSize]
+	if sp == nil || (offset-sp.offset)%sp.objectSize() != 0 {
+		return fmt.Errorf("%w: %p is not an object start", ErrInvalidPointer, ptr)
+	}
+	slot := (offset - sp.offset) / sp.objectSize()
+	if slot >= sp.capacity || !sp.allocated(slot) {
+		return fmt.Errorf("%w: %p is not allocated", ErrInvalidPointer, ptr)
+	}
+
+	sp.bitmap[slot/64] &^= 1 << (slot % 64)
+	sp.inUse--
+	sp.requested[slot] = 0
+	clear(s.memory[offset : offset+sp.objectSize()])
+
+	if sp.inUse == 0 {
+		s.spans[sp.offset/s.spanSize] = nil
+		if s.current[sp.class] == sp {
+			s.current[sp.class] = nil
+		}
+	}
+	return nil
+}
+
+func (s *Slab) partialSpan(class int) *span {
+	for _, sp := range s.spans {
+		if sp != nil && sp.class == class && sp.inUse < sp.capacity {
+			return sp
+		}
+	}
+	return nil
+}
+
+func (s *Slab) newSpan(class int) *span {
+	idx := slices.Index(s.spans, nil)
+	if idx < 0 {
+		return nil
+	}
+	capacity := s.spanSize / sizeClasses[class]
+	sp := &span{
+		offset:    idx * s.spanSize,
+		class:     class,
+		capacity:  capacity,
+		bitmap:    make([]uint64, (capacity+63)/64),
+		requested: make([]int, capacity),
+	}
+	s.spans[idx] = sp
+	return sp
+}
+
+func (s *Slab) Stats() SlabStats {
+	stats := SlabStats{
+		Classes:    make([]ClassStats, len(sizeClasses)),
+		SpansTotal: len(s.spans),
+	}
+	for class, size := range sizeClasses {
+		stats.Classes[class].Size = size
+	}
+
+	var objectBytes, requestedBytes int
+	for _, sp := range s.spans {
+		if sp == nil {
+			continue
+		}
+		class := &stats.Classes[sp.class]
+		class.Spans++
+		class.ObjectsInUse += sp.inUse
+		class.Capacity += sp.capacity
+		for _, requested := range sp.requested {
+			class.RequestedBytes += requested
+			requestedBytes += requested
+		}
+		stats.SpansInUse++
+		objectBytes += sp.inUse * sp.objectSize()
+	}
+
+	if stats.SpansInUse > 0 {
+		spanBytes := float64(stats.SpansInUse * s.spanSize)
+		stats.SpanUtilization = float64(objectBytes) / spanBytes
+		stats.ExternalFragmentation = 1 - stats.SpanUtilization
+	}
+	if objectBytes > 0 {
+		stats.InternalFragmentation = 1 - float64(requestedBytes)/float64(objectBytes)
+	}
+	return stats
+}
+
+func TestSlabSizeClasses(t *testing.T) {
+	memory := make([]byte, 4096)
+	slab, err := NewSlab(memory, 1024)
+	assert.NoError(t, err)
+
+	small, err := slab.Alloc(5)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[0]), small)
+	next, err := slab.Alloc(8)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[8]), next)
+
+	medium, err := slab.Alloc(20)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[1024]), medium)
+
+	_, err = slab.Alloc(2048)
+	assert.Error(t, err)
+
+	stats := slab.Stats()
+	assert.Equal(t, 2, stats.SpansInUse)
+	assert.Equal(t, 4, stats.SpansTotal)
+	assert.Equal(t, ClassStats{Size: 8, Spans: 1, ObjectsInUse: 2, Capacity: 128, RequestedBytes: 13}, stats.Classes[0])
+	assert.Equal(t, ClassStats{Size: 32, Spans: 1, ObjectsInUse: 1, Capacity: 32, RequestedBytes: 20}, stats.Classes[2])
+	assert.InDelta(t, 48.0/2048, stats.SpanUtilization, 1e-9)
+	assert.InDelta(t, 1-33.0/48, stats.InternalFragmentation, 1e-9)
+
+	assert.NoError(t, slab.Free(small))
+	assert.ErrorIs(t, slab.Free(small), ErrInvalidPointer)
+	assert.ErrorIs(t, slab.Free(unsafe.Add(medium, 1)), ErrInvalidPointer)
+	reused, err := slab.Alloc(1)
+	assert.NoError(t, err)
+	assert.Equal(t, small, reused)
+
+	assert.NoError(t, slab.Free(medium))
+	assert.Equal(t, 1, slab.Stats().SpansInUse)
+}
+
+func TestSlabOutOfSpans(t *testing.T) {
+	slab, err := NewSlab(make([]byte, 2048), 1024)
+	assert.NoError(t, err)
+
+	for range 2 {
+		_, err = slab.Alloc(1024)
+		assert.NoError(t, err)
+	}
+	_, err = slab.Alloc(8)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+
+	_, err = slab.Alloc(-5)
+	assert.Error(t, err)
+	assert.Zero(t, slab.Stats().Classes[0].RequestedBytes)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type freeBlock struct {
+	offset, size int
+}
+
+// Strategy chooses a block from the free list (ordered by offset) that can
+// hold blockSize bytes and returns its index or -1.
+type Strategy interface {
+	Place(free []freeBlock, blockSize int) int
+}
+
+type FirstFit struct{}
+
+func (FirstFit) Place(free []freeBlock, blockSize int) int {
+	for i, block := range free {
+		if block.size >= blockSize {
+			return i
+		}
+	}
+	return -1
+}
+
+type BestFit struct{}
+
+func (BestFit) Place(free []freeBlock, blockSize int) int {
+	best := -1
+	for i, block := range free {
+		if block.size >= blockSize && (best < 0 || block.size < free[best].size) {
+			best = i
+		}
+	}
+	return best
+}
+
+type WorstFit struct{}
+
+func (WorstFit) Place(free []freeBlock, blockSize int) int {
+	worst := -1
+	for i, block := range free {
+		if block.size >= blockSize && (worst < 0 || block.size > free[worst].size) {
+			worst = i
+		}
+	}
+	return worst
+}
+
+// NextFit continues searching from the last placement and wraps around.
+// It keeps state, so every arena needs its own instance.
+type NextFit struct {
+	last int
+}
+
+func (s *NextFit) Place(free []freeBlock, blockSize int) int {
+	start := 0
+	for start < len(free) && free[start].offset < s.last {
+		start++
+	}
+	for i := range free {
+		idx := (start + i) % len(free)
+		if free[idx].size >= blockSize {
+			s.last = free[idx].offset
+			return idx
+		}
+	}
+	return -1
+}
+
+type workloadOp struct {
+	alloc bool
+	size  int
+	id    int
+}
+
+type workloadResult struct {
+	allocations int
+	failures    int
+	compactions int
+	// external fragmentation sampled after every operation that reached
+	// the arena
+	samples           int
+	meanFragmentation float64
+	peakFragmentation float64
+}
+
+const workloadMaxLive = 56
+
+func generateWorkload(seed uint64, count int) []workloadOp {
+	random := rand.New(rand.NewPCG(seed, seed))
+	ops := make([]workloadOp, 0, count)
+	var live []int
+	for id := 0; len(ops) < count; {
+		if len(live) >= workloadMaxLive || len(live) > 0 && random.IntN(2) == 0 {
+			idx := random.IntN(len(live))
+			ops = append(ops, workloadOp{id: live[idx]})
+			live[idx] = live[len(live)-1]
+			live = live[:len(live)-1]
+			continue
+		}
+		ops = append(ops, workloadOp{alloc: true, size: 1 + random.IntN(96), id: id})
+		live = append(live, id)
+		id++
+	}
+	return ops
+}
+
+func runWorkload(arena *Arena, ops []workloadOp) (workloadResult, error) {
+	var result workloadResult
+	handles := make(map[int]Handle)
+	for _, op := range ops {
+		if !op.alloc {
+			handle, ok := handles[op.id]
+			if !ok {
+				continue
+			}
+			delete(handles, op.id)
+			if err := arena.FreeHandle(handle); err != nil {
+				return result, err
+			}
+			result.sample(arena)
+			continue
+		}
+
+		handle, err := arena.AllocHandle(op.size)
+		if errors.Is(err, ErrOutOfMemory) {
+			result.failures++
+			result.sample(arena)
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		handles[op.id] = handle
+		result.allocations++
+		result.sample(arena)
+	}
+	result.compactions = arena.Compactions()
+	if result.samples > 0 {
+		result.meanFragmentation /= float64(result.samples)
+	}
+	return result, nil
+}
+
+func (r *workloadResult) sample(arena *Arena) {
+	fragmentation := arena.Fragmentation().ExternalFragmentation
+	r.samples++
+	r.meanFragmentation += fragmentation
+	r.peakFragmentation = max(r.peakFragmentation, fragmentation)
+}
+
+var strategies = map[string]func() Strategy{
+	"first-fit": func() Strategy { return FirstFit{} },
+	"best-fit":  func() Strategy { return BestFit{} },
+	"next-fit":  func() Strategy { return &NextFit{} },
+	"worst-fit": func() Strategy { return WorstFit{} },
+}
+
+func TestStrategies(t *testing.T) {
+	free := []freeBlock{
+		{offset: 0, size: 32},
+		{offset: 64, size: 16},
+		{offset: 128, size: 64},
+		{offset: 256, size: 24},
+	}
+
+	tests := map[string]struct {
+		strategy Strategy
+		result   []int
+	}{
+		"first fit": {
+			strategy: FirstFit{},
+			result:   []int{0, 0, 0},
+		},
+		"best fit": {
+			strategy: BestFit{},
+			result:   []int{1, 3, 3},
+		},
+		"worst fit": {
+			strategy: WorstFit{},
+			result:   []int{2, 2, 2},
+		},
+		"next fit": {
+			strategy: &NextFit{},
+			result:   []int{0, 0, 0},
+		},
+		"next fit after placement": {
+			strategy: &NextFit{last: 100},
+			result:   []int{2, 2, 2},
+		},
+		"next fit wraps around": {
+			strategy: &NextFit{last: 200},
+			result:   []int{3, 3, 3},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var result []int
+			for _, size := range []int{16, 24, 24} {
+				result = append(result, test.strategy.Place(free, size))
+			}
+			assert.Equal(t, test.result, result)
+			assert.Equal(t, -1, test.strategy.Place(free, 128))
+		})
+	}
+}
+
+func TestWorkloadWithStrategies(t *testing.T) {
+	ops := generateWorkload(1, 2000)
+	results := make(map[string]workloadResult)
+	for name, strategy := range strategies {
+		t.Run(name, func(t *testing.T) {
+			arena, err := NewArena(4096, WithStrategy(strategy()))
+			assert.NoError(t, err)
+
+			result, err := runWorkload(arena, ops)
+			assert.NoError(t, err)
+			assert.Positive(t, result.allocations)
+			assert.GreaterOrEqual(t, result.peakFragmentation, result.meanFragmentation)
+			t.Logf("fragmentation: mean %.3f, peak %.3f", result.meanFragmentation, result.peakFragmentation)
+			results[name] = result
+		})
+	}
+
+	// policies that keep large blocks intact fragment less
+	for _, tight := range []string{"first-fit", "best-fit"} {
+		for _, loose := range []string{"next-fit", "worst-fit"} {
+			assert.Less(t, results[tight].meanFragmentation, results[loose].meanFragmentation, "%s vs %s", tight, loose)
+		}
+	}
+	assert.LessOrEqual(t, results["best-fit"].compactions, results["worst-fit"].compactions)
+}
+
+// go test -bench=Strategies -run=^$ .
+func BenchmarkStrategies(b *testing.B) {
+	ops := generateWorkload(1, 2000)
+	for name, strategy := range strategies {
+		b.Run(name, func(b *testing.B) {
+			var result workloadResult
+			for b.Loop() {
+				arena, err := NewArena(4096, WithStrategy(strategy()))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if result, err = runWorkload(arena, ops); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(result.compactions), "compactions/op")
+			b.ReportMetric(float64(result.failures), "failures/op")
+			b.ReportMetric(result.meanFragmentation, "mean-fragmentation")
+			b.ReportMetric(result.peakFragmentation, "peak-fragmentation")
+		})
+	}
+}
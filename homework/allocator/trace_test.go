@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type EventKind byte
+
+const (
+	EventAlloc EventKind = iota + 1
+	EventFree
+	EventCompact
+)
+
+// Event is one step of an allocation trace. IDs are assigned by the
+// recorder and only link a free to its alloc.
+type Event struct {
+	Kind  EventKind
+	ID    uint64
+	Size  int
+	Align int
+}
+
+var (
+	ErrBadTrace = errors.New("malformed trace")
+
+	traceMagic = []byte("ATR1")
+)
+
+// Text format, one event per line, '#' starts a comment:
+//
+//	alloc <id> <size> <align>
+//	free <id>
+//	compact
+func WriteText(w io.Writer, events []Event) error {
+	for _, event := range events {
+		var err error
+		switch event.Kind {
+		case EventAlloc:
+			_, err = fmt.Fprintf(w, "alloc %d %d %d\n", event.ID, event.Size, event.Align)
+		case EventFree:
+			_, err = fmt.Fprintf(w, "free %d\n", event.ID)
+		case EventCompact:
+			_, err = fmt.Fprintln(w, "compact")
+		default:
+			err = fmt.Errorf("%w: unknown event kind %d", ErrBadTrace, event.Kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ReadText(r io.Reader) ([]Event, error) {
+	var events []Event
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var event Event
+		var err error
+		switch {
+		case fields[0] == "alloc" && len(fields) == 4:
+			event.Kind = EventAlloc
+			_, err = fmt.Sscan(strings.Join(fields[1:], " "), &event.ID, &event.Size, &event.Align)
+		case fields[0] == "free" && len(fields) == 2:
+			event.Kind = EventFree
+			_, err = fmt.Sscan(fields[1], &event.ID)
+		case fields[0] == "compact" && len(fields) == 1:
+			event.Kind = EventCompact
+		default:
+			err = errors.New(text)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrBadTrace, line, err)
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// Binary format: magic "ATR1", then for every event the kind byte followed
+// by uvarints: id, size and align for alloc, id for free, nothing for compact.
+func WriteBinary(w io.Writer, events []Event) error {
+	buf := append([]byte(nil), traceMagic...)
+	for _, event := range events {
+		buf = append(buf, byte(event.Kind))
+		switch event.Kind {
+		case EventAlloc:
+			buf = binary.AppendUvarint(buf, event.ID)
+			buf = binary.AppendUvarint(buf, uint64(event.Size))
+			buf = binary.AppendUvarint(buf, uint64(event.Align))
+		case EventFree:
+			buf = binary.AppendUvarint(buf, event.ID)
+		case EventCompact:
+		default:
+			return fmt.Errorf("%w: unknown event kind %d", ErrBadTrace, event.Kind)
+		}
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func ReadBinary(r io.Reader) ([]Event, error) {
+	reader := bufio.NewReader(r)
+	magic := make([]byte, len(traceMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || !bytes.Equal(magic, traceMagic) {
+		return nil, fmt.Errorf("%w: bad magic", ErrBadTrace)
+	}
+
+	var events []Event
+	for {
+		kind, err := reader.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		event := Event{Kind: EventKind(kind)}
+		var fields []*uint64
+		var size, align uint64
+		switch event.Kind {
+		case EventAlloc:
+			fields = []*uint64{&event.ID, &size, &align}
+		case EventFree:
+			fields = []*uint64{&event.ID}
+		case EventCompact:
+		default:
+			return nil, fmt.Errorf("%w: unknown event kind %d", ErrBadTrace, kind)
+		}
+		for _, field := range fields {
+			if *field, err = binary.ReadUvarint(reader); err != nil {
+				return nil, fmt.Errorf("%w: truncated event %d", ErrBadTrace, len(events))
+			}
+		}
+		event.Size, event.Align = int(size), int(align)
+		events = append(events, event)
+	}
+}
+
+// Recorder wraps an arena and records every call as an Event.
+type Recorder struct {
+	arena  *Arena
+	events []Event
+	ids    map[Handle]uint64
+	nextID uint64
+}
+
+func NewRecorder(arena *Arena) *Recorder {
+	return &Recorder{arena: arena, ids: make(map[Handle]uint64)}
+}
+
+func (r *Recorder) Alloc(size, align int) (Handle, error) {
+	r.nextID++
+	r.events = append(r.events, Event{Kind: EventAlloc, ID: r.nextID, Size: size, Align: align})
+	handle, err := r.arena.AllocHandleAligned(size, align)
+	if err != nil {
+		return 0, err
+	}
+	r.ids[handle] = r.nextID
+	return handle, nil
+}
+
+func (r *Recorder) Free(handle Handle) error {
+	if err := r.arena.FreeHandle(handle); err != nil {
+		return err
+	}
+	r.events = append(r.events, Event{Kind: EventFree, ID: r.ids[handle]})
+	delete(r.ids, handle)
+	return nil
+}
+
+func (r *Recorder) Compact() (CompactStats, error) {
+	r.events = append(r.events, Event{Kind: EventCompact})
+	return r.arena.Compact()
+}
+
+func (r *Recorder) Events() []Event {
+	return r.events
+}
+
+type ReplayStats struct {
+	Events      int
+	Allocations int
+	Failures    int
+	// PeakBytes is the largest amount of memory taken by allocated blocks.
+	PeakBytes int
+	// Compactions counts explicit compactions and the ones Alloc ran on its own.
+	Compactions int
+	// Fragmentation is the external fragmentation after every event.
+	Fragmentation []float64
+}
+
+func Replay(arena *Arena, events []Event) (ReplayStats, error) {
+	stats := ReplayStats{Events: len(events)}
+	compactions := arena.Compactions()
+	handles := make(map[uint64]Handle)
+	for i, event := range events {
+		switch event.Kind {
+		case EventAlloc:
+			handle, err := arena.AllocHandleAligned(event.Size, max(event.Align, 1))
+			if errors.Is(err, ErrOutOfMemory) {
+				stats.Failures++
+				break
+			}
+			if err != nil {
+				return stats, fmt.Errorf("event %d: %w", i, err)
+			}
+			handles[event.ID] = handle
+			stats.Allocations++
+		case EventFree:
+			handle, ok := handles[event.ID]
+			if !ok {
+				break
+			}
+			delete(handles, event.ID)
+			if err := arena.FreeHandle(handle); err != nil {
+				return stats, fmt.Errorf("event %d: %w", i, err)
+			}
+		case EventCompact:
+			if _, err := arena.Compact(); err != nil {
+				return stats, fmt.Errorf("event %d: %w", i, err)
+			}
+		default:
+			return stats, fmt.Errorf("%w: unknown event kind %d", ErrBadTrace, event.Kind)
+		}
+
+		report := arena.Fragmentation()
+		stats.PeakBytes = max(stats.PeakBytes, report.TotalBytes-report.FreeBytes)
+		stats.Fragmentation = append(stats.Fragmentation, report.ExternalFragmentation)
+	}
+	stats.Compactions = arena.Compactions() - compactions
+	return stats, nil
+}
+
+func TestTraceFormats(t *testing.T) {
+	events := []Event{
+		{Kind: EventAlloc, ID: 1, Size: 24, Align: 8},
+		{Kind: EventAlloc, ID: 2, Size: 300, Align: 16},
+		{Kind: EventFree, ID: 1},
+		{Kind: EventCompact},
+	}
+
+	var text bytes.Buffer
+	assert.NoError(t, WriteText(&text, events))
+	assert.Equal(t, "alloc 1 24 8\nalloc 2 300 16\nfree 1\ncompact\n", text.String())
+	parsed, err := ReadText(strings.NewReader("# recorded trace\n" + text.String() + "\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, events, parsed)
+
+	var binaryTrace bytes.Buffer
+	assert.NoError(t, WriteBinary(&binaryTrace, events))
+	parsed, err = ReadBinary(&binaryTrace)
+	assert.NoError(t, err)
+	assert.Equal(t, events, parsed)
+
+	_, err = ReadText(strings.NewReader("alloc 1\n"))
+	assert.ErrorIs(t, err, ErrBadTrace)
+	_, err = ReadBinary(bytes.NewReader([]byte("ATR1\x01\x01")))
+	assert.ErrorIs(t, err, ErrBadTrace)
+	_, err = ReadBinary(bytes.NewReader([]byte("nope")))
+	assert.ErrorIs(t, err, ErrBadTrace)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	arena, err := NewArena(64)
+	assert.NoError(t, err)
+	recorder := NewRecorder(arena)
+
+	var handles []Handle
+	for range 4 {
+		handle, err := recorder.Alloc(8, 1)
+		assert.NoError(t, err)
+		handles = append(handles, handle)
+	}
+	assert.NoError(t, recorder.Free(handles[0]))
+	assert.NoError(t, recorder.Free(handles[2]))
+	_, err = recorder.Alloc(24, 1)
+	assert.NoError(t, err)
+	_, err = recorder.Alloc(8, 1)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	assert.Len(t, recorder.Events(), 8)
+
+	replayArena, err := NewArena(64)
+	assert.NoError(t, err)
+	stats, err := Replay(replayArena, recorder.Events())
+	assert.NoError(t, err)
+	assert.Equal(t, 8, stats.Events)
+	assert.Equal(t, 5, stats.Allocations)
+	assert.Equal(t, 1, stats.Failures)
+	assert.Equal(t, 64, stats.PeakBytes)
+	// the failed allocation finds the arena full and does not compact
+	assert.Equal(t, 1, stats.Compactions)
+	assert.Equal(t, []float64{0, 0, 0, 0, 0, 0.5, 0, 0}, stats.Fragmentation)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var ErrHeapPointer = errors.New("type contains Go heap pointers")
+
+// Ref is a typed reference to a value stored in the arena. It keeps the
+// handle rather than the address, so it stays valid across compactions.
+type Ref[T any] struct {
+	arena  *Arena
+	handle Handle
+}
+
+// New allocates zeroed storage for T with the size and alignment of T.
+// The garbage collector does not scan arena memory, so T must not contain
+// pointers, strings, slices, maps, channels, functions or interfaces.
+func New[T any](arena *Arena) (Ref[T], error) {
+	if err := checkNoPointers(reflect.TypeFor[T]()); err != nil {
+		return Ref[T]{}, err
+	}
+	var zero T
+	handle, err := arena.AllocHandleAligned(int(unsafe.Sizeof(zero)), int(unsafe.Alignof(zero)))
+	if err != nil {
+		return Ref[T]{}, err
+	}
+	return Ref[T]{arena: arena, handle: handle}, nil
+}
+
+// Get returns the current address of the value or nil if it has been
+// freed. The pointer must not be kept across compactions.
+func (r Ref[T]) Get() *T {
+	ptr, err := r.arena.Resolve(r.handle)
+	if err != nil {
+		return nil
+	}
+	return (*T)(ptr)
+}
+
+func (r Ref[T]) Free() error {
+	return r.arena.FreeHandle(r.handle)
+}
+
+func checkNoPointers(typ reflect.Type) error {
+	switch typ.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return nil
+	case reflect.Array:
+		return checkNoPointers(typ.Elem())
+	case reflect.Struct:
+		for i := range typ.NumField() {
+			field := typ.Field(i)
+			if err := checkNoPointers(field.Type); err != nil {
+				return fmt.Errorf("field %s: %w", field.Name, err)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrHeapPointer, typ)
+	}
+}
+
+type point struct {
+	X, Y int32
+	Tag  [3]byte
+	Z    float64
+}
+
+func TestTypedRef(t *testing.T) {
+	arena, err := NewArena(256)
+	assert.NoError(t, err)
+
+	padding, err := New[[5]byte](arena)
+	assert.NoError(t, err)
+	first, err := New[point](arena)
+	assert.NoError(t, err)
+	second, err := New[uint64](arena)
+	assert.NoError(t, err)
+
+	assert.Equal(t, point{}, *first.Get())
+	*first.Get() = point{X: 1, Y: -2, Tag: [3]byte{'a', 0, 'c'}, Z: 3.5}
+	*second.Get() = 42
+	assert.Zero(t, uintptr(unsafe.Pointer(first.Get()))%unsafe.Alignof(point{}))
+
+	before := first.Get()
+	assert.NoError(t, padding.Free())
+	assert.Nil(t, padding.Get())
+	_, err = arena.Compact()
+	assert.NoError(t, err)
+
+	assert.NotEqual(t, before, first.Get())
+	assert.Equal(t, point{X: 1, Y: -2, Tag: [3]byte{'a', 0, 'c'}, Z: 3.5}, *first.Get())
+	assert.Equal(t, uint64(42), *second.Get())
+}
+
+func TestTypedRefRejectsPointers(t *testing.T) {
+	arena, err := NewArena(64)
+	assert.NoError(t, err)
+
+	_, err = New[*int](arena)
+	assert.ErrorIs(t, err, ErrHeapPointer)
+	_, err = New[string](arena)
+	assert.ErrorIs(t, err, ErrHeapPointer)
+	_, err = New[struct {
+		ID   int
+		Tags []string
+	}](arena)
+	assert.ErrorIs(t, err, ErrHeapPointer)
+	_, err = New[[2]any](arena)
+	assert.ErrorIs(t, err, ErrHeapPointer)
+	_, err = New[struct{ A [4]uint16 }](arena)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Semispace is a copying collector. Objects are bump allocated in
+// from-space; Collect evacuates the objects reachable from the stacks into
+// to-space in Cheney's breadth-first order, leaves a forwarding address in
+// the first word of every evacuated object, rewrites the root slots and
+// swaps the spaces. Survivors end up next to each other, so the free
+// memory is always one span.
+type Semispace struct {
+	from, to *Heap
+}
+
+type CopyStats struct {
+	CopiedObjects int
+	CopiedBytes   uintptr
+	FreedObjects  int
+	FreedBytes    uintptr
+}
+
+// NewSemispace splits [base, base+size) into two halves.
+func NewSemispace(base, size uintptr) *Semispace {
+	half := size / 2 &^ (wordSize - 1)
+	return &Semispace{from: NewHeap(base, half), to: NewHeap(base+half, half)}
+}
+
+func (s *Semispace) Alloc(typ *TypeDesc) (uintptr, error) {
+	return s.from.AllocTyped(typ)
+}
+
+func (s *Semispace) Load(addr uintptr) (uintptr, error) {
+	return s.from.Load(addr)
+}
+
+func (s *Semispace) Store(addr, value uintptr) error {
+	return s.from.Store(addr, value)
+}
+
+// Heap returns the space objects are allocated in.
+func (s *Semispace) Heap() *Heap {
+	return s.from
+}
+
+func (s *Semispace) Collect(stacks [][]uintptr) CopyStats {
+	var stats CopyStats
+	for _, roots := range stacks {
+		for i, root := range roots {
+			roots[i] = s.evacuate(root, &stats)
+		}
+	}
+
+	// to-space between scan and the allocation top is the queue of
+	// copied objects whose fields still point to from-space
+	for scan := s.to.base; scan < s.top(); {
+		s.to.forEachPointer(scan, func(slot, value uintptr) {
+			_ = s.to.Store(slot, s.evacuate(value, &stats))
+		})
+		scan += s.to.objects[scan].size
+	}
+
+	for _, obj := range s.from.objects {
+		if !obj.forwarded {
+			stats.FreedObjects++
+			stats.FreedBytes += obj.size
+		}
+	}
+	s.from, s.to = s.to, NewHeap(s.from.base, uintptr(len(s.from.words))*wordSize)
+	return stats
+}
+
+// evacuate returns the to-space address of a from-space object, copying
+// it on the first visit. Other values are not pointers and are returned
+// as is.
+func (s *Semispace) evacuate(addr uintptr, stats *CopyStats) uintptr {
+	obj, ok := s.from.objects[addr]
+	if !ok {
+		return addr
+	}
+	if obj.forwarded {
+		forward, _ := s.from.Load(addr)
+		return forward
+	}
+
+	// to-space has the size of from-space, so the copy always fits
+	copied, _ := s.to.alloc(obj.size, obj.typ)
+	from, _ := s.from.index(addr)
+	to, _ := s.to.index(copied)
+	words := int(obj.size / wordSize)
+	copy(s.to.words[to:to+words], s.from.words[from:from+words])
+
+	obj.forwarded = true
+	_ = s.from.Store(addr, copied)
+	stats.CopiedObjects++
+	stats.CopiedBytes += obj.size
+	return copied
+}
+
+// top is the allocation pointer of to-space, which only bump allocates.
+func (s *Semispace) top() uintptr {
+	if len(s.to.free) == 0 {
+		return s.to.base + uintptr(len(s.to.words))*wordSize
+	}
+	return s.to.free[0].addr
+}
+
+func TestSemispaceCollect(t *testing.T) {
+	space := NewSemispace(0x1000, 64*wordSize)
+	node := NewType("node", 2*wordSize, 0, 1)
+	data := NewType("[2]int", 2*wordSize)
+
+	// a -> b, a -> c, b -> c, c -> a; d is garbage
+	a, _ := space.Alloc(node)
+	d, _ := space.Alloc(node)
+	b, _ := space.Alloc(node)
+	c, _ := space.Alloc(data)
+	assert.NoError(t, space.Store(a, b))
+	assert.NoError(t, space.Store(a+wordSize, c))
+	assert.NoError(t, space.Store(b, c))
+	assert.NoError(t, space.Store(c, a))
+	assert.NoError(t, space.Store(c+wordSize, 42))
+	assert.NoError(t, space.Store(d, a))
+
+	stacks := [][]uintptr{{7, a}, {c, 0}}
+	stats := space.Collect(stacks)
+	assert.Equal(t, CopyStats{
+		CopiedObjects: 3,
+		CopiedBytes:   6 * wordSize,
+		FreedObjects:  1,
+		FreedBytes:    2 * wordSize,
+	}, stats)
+
+	// breadth-first from the roots: a, c, then b found in a
+	newA, newC := stacks[0][1], stacks[1][0]
+	assert.Equal(t, uintptr(7), stacks[0][0])
+	assert.Equal(t, 0x1000+32*wordSize, newA)
+	assert.Equal(t, newA+2*wordSize, newC)
+	newB, _ := space.Load(newA)
+	assert.Equal(t, newC+2*wordSize, newB)
+
+	// c holds data, so the word that equals the old a is not rewritten
+	value, _ := space.Load(newC)
+	assert.Equal(t, a, value)
+	value, _ = space.Load(newA + wordSize)
+	assert.Equal(t, newC, value)
+	value, _ = space.Load(newB)
+	assert.Equal(t, newC, value)
+	assert.Len(t, space.Heap().objects, 3)
+
+	// the next collection copies back into the first half
+	stats = space.Collect(stacks)
+	assert.Equal(t, 3, stats.CopiedObjects)
+	assert.Equal(t, a, stacks[0][1])
+}
+
+func TestSemispaceRemovesFragmentation(t *testing.T) {
+	space := NewSemispace(0x1000, 64*wordSize)
+	heap := NewHeap(0x1000, 32*wordSize)
+	cell := NewType("cell", 2*wordSize, 0)
+
+	var stacks, spaceStacks [][]uintptr
+	for i := range 16 {
+		addr, err := heap.AllocTyped(cell)
+		assert.NoError(t, err)
+		spaceAddr, err := space.Alloc(cell)
+		assert.NoError(t, err)
+		if i%2 == 0 {
+			stacks = append(stacks, []uintptr{addr})
+			spaceStacks = append(spaceStacks, []uintptr{spaceAddr})
+		}
+	}
+
+	heap.Collect(stacks)
+	assert.InDelta(t, 0.875, heap.Fragmentation(), 1e-9)
+	_, err := heap.Alloc(4 * wordSize)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+
+	stats := space.Collect(spaceStacks)
+	assert.Equal(t, 8, stats.CopiedObjects)
+	assert.Equal(t, 16*wordSize, stats.CopiedBytes)
+	assert.Zero(t, space.Heap().Fragmentation())
+	_, err = space.Alloc(NewType("big", 16*wordSize))
+	assert.NoError(t, err)
+}
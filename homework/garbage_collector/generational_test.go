@@ -0,0 +1,217 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Generational splits the heap into young objects (the nursery) and old
+// ones. A minor collection traces only young objects: its roots are the
+// stacks and the remembered set, the pointer slots of old objects that
+// may refer to young ones. The mutator must store pointers through Write,
+// whose barrier maintains the remembered set. Young objects that survive
+// promoteAfter minor collections become old; old garbage is only freed by
+// a major collection.
+type Generational struct {
+	heap         *Heap
+	promoteAfter int
+	remembered   map[uintptr]struct{}
+}
+
+type MinorStats struct {
+	CollectStats
+	// Traced is the number of young objects scanned.
+	Traced   int
+	Promoted int
+	// Remembered is the number of remembered slots used as roots.
+	Remembered int
+}
+
+func NewGenerational(heap *Heap, promoteAfter int) *Generational {
+	return &Generational{heap: heap, promoteAfter: promoteAfter, remembered: make(map[uintptr]struct{})}
+}
+
+// Alloc allocates in the nursery.
+func (g *Generational) Alloc(typ *TypeDesc) (uintptr, error) {
+	return g.heap.AllocTyped(typ)
+}
+
+func (g *Generational) Write(addr, value uintptr) error {
+	if err := g.heap.Store(addr, value); err != nil {
+		return err
+	}
+	g.remember(addr, value)
+	return nil
+}
+
+// remember is the write barrier: it records slots of old objects that
+// point to young objects.
+func (g *Generational) remember(slot, value uintptr) {
+	if !g.young(value) {
+		return
+	}
+	if _, obj, ok := g.heap.objectAt(slot); ok && obj.old {
+		g.remembered[slot] = struct{}{}
+	}
+}
+
+func (g *Generational) young(addr uintptr) bool {
+	obj, ok := g.heap.objects[addr]
+	return ok && !obj.old
+}
+
+func (g *Generational) Minor(stacks [][]uintptr) MinorStats {
+	var stats MinorStats
+	var grey []uintptr
+	shade := func(addr uintptr) {
+		if obj, ok := g.heap.objects[addr]; ok && !obj.old && !obj.marked {
+			obj.marked = true
+			grey = append(grey, addr)
+		}
+	}
+	for _, roots := range stacks {
+		for _, root := range roots {
+			shade(root)
+		}
+	}
+	for slot := range g.remembered {
+		value, _ := g.heap.Load(slot)
+		if g.young(value) {
+			stats.Remembered++
+			shade(value)
+		}
+	}
+
+	var survivors []uintptr
+	for len(grey) > 0 {
+		current := grey[len(grey)-1]
+		grey = grey[:len(grey)-1]
+		survivors = append(survivors, current)
+		stats.Traced++
+		g.heap.forEachPointer(current, func(_, value uintptr) {
+			shade(value)
+		})
+	}
+	stats.MarkedObjects = len(survivors)
+
+	// old objects are not collected by a minor collection
+	for _, obj := range g.heap.objects {
+		if obj.old {
+			obj.marked = true
+		}
+	}
+	g.heap.sweep(&stats.CollectStats)
+
+	for _, addr := range survivors {
+		obj := g.heap.objects[addr]
+		if obj.age++; obj.age >= g.promoteAfter {
+			obj.old = true
+			stats.Promoted++
+			g.heap.forEachPointer(addr, g.remember)
+		}
+	}
+	g.prune()
+	return stats
+}
+
+// Major collects the whole heap.
+func (g *Generational) Major(stacks [][]uintptr) CollectStats {
+	stats := g.heap.Collect(stacks)
+	g.prune()
+	return stats
+}
+
+func (g *Generational) Remembered() int {
+	return len(g.remembered)
+}
+
+// prune drops slots that no longer point to young objects or whose
+// objects have been freed.
+func (g *Generational) prune() {
+	for slot := range g.remembered {
+		value, _ := g.heap.Load(slot)
+		_, obj, ok := g.heap.objectAt(slot)
+		if !ok || !obj.old || !g.young(value) {
+			delete(g.remembered, slot)
+		}
+	}
+}
+
+func TestGenerationalPromotion(t *testing.T) {
+	heap := NewHeap(0x1000, 64*wordSize)
+	gen := NewGenerational(heap, 2)
+	node := NewType("node", 2*wordSize, 0, 1)
+
+	parent, _ := gen.Alloc(node)
+	child, _ := gen.Alloc(node)
+	assert.NoError(t, gen.Write(parent, child))
+	stacks := [][]uintptr{{parent}}
+
+	stats := gen.Minor(stacks)
+	assert.Equal(t, 2, stats.Traced)
+	assert.Zero(t, stats.Promoted)
+	stats = gen.Minor(stacks)
+	assert.Equal(t, 2, stats.Promoted)
+	assert.True(t, heap.objects[parent].old)
+
+	// old objects are not traced again
+	garbage, _ := gen.Alloc(node)
+	stats = gen.Minor(stacks)
+	assert.Zero(t, stats.Traced)
+	assert.Equal(t, 1, stats.FreedObjects)
+	assert.Equal(t, 2, stats.LiveObjects)
+	assert.NotContains(t, heap.objects, garbage)
+
+	// old garbage survives minor collections
+	stats = gen.Minor(nil)
+	assert.Zero(t, stats.FreedObjects)
+	assert.Equal(t, 2, gen.Major(nil).FreedObjects)
+	assert.Empty(t, heap.objects)
+}
+
+func TestRememberedSet(t *testing.T) {
+	heap := NewHeap(0x1000, 64*wordSize)
+	gen := NewGenerational(heap, 1)
+	node := NewType("node", 2*wordSize, 0, 1)
+
+	old, _ := gen.Alloc(node)
+	stacks := [][]uintptr{{old}}
+	assert.Equal(t, 1, gen.Minor(stacks).Promoted)
+
+	// young is reachable only through the old object
+	young, _ := gen.Alloc(node)
+	grandchild, _ := gen.Alloc(node)
+	assert.NoError(t, gen.Write(young+wordSize, grandchild))
+	assert.NoError(t, gen.Write(old+wordSize, young))
+	assert.Equal(t, 1, gen.Remembered())
+
+	stats := gen.Minor(stacks)
+	assert.Equal(t, 1, stats.Remembered)
+	assert.Equal(t, 2, stats.Traced)
+	assert.Equal(t, 2, stats.Promoted)
+	assert.Zero(t, stats.FreedObjects)
+	// all three are old now, nothing refers to the nursery
+	assert.Zero(t, gen.Remembered())
+
+	fresh, _ := gen.Alloc(node)
+	assert.NoError(t, gen.Write(grandchild, fresh))
+	assert.Equal(t, 1, gen.Remembered())
+	assert.NoError(t, gen.Write(grandchild, 0))
+	stats = gen.Minor(stacks)
+	assert.Zero(t, stats.Remembered)
+	assert.Equal(t, 1, stats.FreedObjects)
+	assert.Zero(t, gen.Remembered())
+
+	// a promoted object pointing to a younger survivor is remembered
+	gen = NewGenerational(heap, 2)
+	first, _ := gen.Alloc(node)
+	assert.Equal(t, 0, gen.Minor([][]uintptr{{first}}).Promoted)
+	second, _ := gen.Alloc(node)
+	assert.NoError(t, gen.Write(first, second))
+	assert.Equal(t, 1, gen.Minor([][]uintptr{{first}}).Promoted)
+	assert.Equal(t, 1, gen.Remembered())
+	stats = gen.Minor(nil)
+	assert.Equal(t, 1, stats.Remembered)
+	assert.Contains(t, heap.objects, second)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var ErrOutOfMemory = errors.New("out of memory")
+
+var _ Memory = (*Heap)(nil)
+
+// Heap is a simulated heap: addresses are synthetic numbers inside
+// [base, base+size) and memory is an array of words, so the collector can
+// follow pointers without touching real memory. Every allocation is an
+// entry of the object table.
+type Heap struct {
+	base    uintptr
+	words   []uintptr
+	objects map[uintptr]*object
+	free    []span // sorted by address, adjacent spans are merged
+}
+
+type object struct {
+	size   uintptr
+	typ    *TypeDesc // nil for objects from Alloc
+	marked bool
+	// generational collector: survived minor collections and tenure
+	age int
+	old bool
+	// copying collector: the first word holds the new address
+	forwarded bool
+}
+
+// pointerAt tells whether the word of the object may hold a pointer.
+// Objects without a descriptor are cells like the ones Trace follows:
+// only the first word is a pointer.
+func (o *object) pointerAt(word int) bool {
+	if o.typ == nil {
+		return word == 0
+	}
+	return o.typ.pointerAt(word)
+}
+
+type span struct {
+	addr, size uintptr
+}
+
+type CollectStats struct {
+	MarkedObjects int
+	FreedObjects  int
+	FreedBytes    uintptr
+	LiveObjects   int
+	LiveBytes     uintptr
+}
+
+func NewHeap(base, size uintptr) *Heap {
+	size &^= wordSize - 1
+	return &Heap{
+		base:    base,
+		words:   make([]uintptr, size/wordSize),
+		objects: make(map[uintptr]*object),
+		free:    []span{{addr: base, size: size}},
+	}
+}
+
+// Alloc returns the address of a zeroed object of size bytes rounded up
+// to whole words. Memory is taken from the free list with first fit.
+func (h *Heap) Alloc(size uintptr) (uintptr, error) {
+	return h.alloc(size, nil)
+}
+
+// AllocTyped allocates an object described by typ; the collector scans
+// exactly the words marked in its pointer bitmap.
+func (h *Heap) AllocTyped(typ *TypeDesc) (uintptr, error) {
+	return h.alloc(typ.Size, typ)
+}
+
+func (h *Heap) alloc(size uintptr, typ *TypeDesc) (uintptr, error) {
+	// rounding a huge size up would wrap around to zero
+	if size > uintptr(len(h.words))*wordSize {
+		return 0, fmt.Errorf("%w: requested %d bytes", ErrOutOfMemory, size)
+	}
+	size = max(alignUp(size, wordSize), wordSize)
+	for i, free := range h.free {
+		if free.size < size {
+			continue
+		}
+		if free.size == size {
+			h.free = slices.Delete(h.free, i, i+1)
+		} else {
+			h.free[i] = span{addr: free.addr + size, size: free.size - size}
+		}
+		h.objects[free.addr] = &object{size: size, typ: typ}
+		return free.addr, nil
+	}
+	return 0, fmt.Errorf("%w: requested %d bytes", ErrOutOfMemory, size)
+}
+
+func (h *Heap) Load(addr uintptr) (uintptr, error) {
+	idx, err := h.index(addr)
+	if err != nil {
+		return 0, err
+	}
+	return h.words[idx], nil
+}
+
+func (h *Heap) Store(addr, value uintptr) error {
+	idx, err := h.index(addr)
+	if err != nil {
+		return err
+	}
+	h.words[idx] = value
+	return nil
+}
+
+func (h *Heap) index(addr uintptr) (int, error) {
+	if addr < h.base || addr-h.base >= uintptr(len(h.words))*wordSize || (addr-h.base)%wordSize != 0 {
+		return 0, fmt.Errorf("%w: %#x", ErrInvalidAddress, addr)
+	}
+	return int((addr - h.base) / wordSize), nil
+}
+
+// objectAt returns the object that contains addr.
+func (h *Heap) objectAt(addr uintptr) (uintptr, *object, bool) {
+	if addr < h.base || addr-h.base >= uintptr(len(h.words))*wordSize {
+		return 0, nil, false
+	}
+	for start := addr - (addr-h.base)%wordSize; ; start -= wordSize {
+		if obj, ok := h.objects[start]; ok {
+			return start, obj, addr < start+obj.size
+		}
+		if start == h.base {
+			return 0, nil, false
+		}
+	}
+}
+
+// Collect marks everything reachable from the stacks the way Trace does,
+// following every pointer word of the objects, and sweeps unmarked
+// objects into the free list.
+func (h *Heap) Collect(stacks [][]uintptr) CollectStats {
+	stats := CollectStats{MarkedObjects: h.mark(stacks)}
+	h.sweep(&stats)
+	return stats
+}
+
+// sweep frees unmarked objects and clears the marks of the others.
+func (h *Heap) sweep(stats *CollectStats) {
+	for addr, obj := range h.objects {
+		if obj.marked {
+			obj.marked = false
+			stats.LiveObjects++
+			stats.LiveBytes += obj.size
+			continue
+		}
+		stats.FreedObjects++
+		stats.FreedBytes += obj.size
+		h.release(addr)
+	}
+	h.mergeFree()
+}
+
+func (h *Heap) mark(stacks [][]uintptr) int {
+	var stack []uintptr
+	marked := 0
+	push := func(ptr uintptr) {
+		if obj, ok := h.objects[ptr]; ok && !obj.marked {
+			obj.marked = true
+			marked++
+			stack = append(stack, ptr)
+		}
+	}
+
+	for i := len(stacks) - 1; i >= 0; i-- {
+		for j := len(stacks[i]) - 1; j >= 0; j-- {
+			push(stacks[i][j])
+		}
+	}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		// the children are reversed, so the first field is visited first
+		children := len(stack)
+		h.forEachPointer(current, func(_, value uintptr) {
+			push(value)
+		})
+		slices.Reverse(stack[children:])
+	}
+	return marked
+}
+
+// forEachPointer calls fn for every pointer slot of the object at addr,
+// in address order, with the value the slot holds.
+func (h *Heap) forEachPointer(addr uintptr, fn func(slot, value uintptr)) {
+	obj := h.objects[addr]
+	for word := range int(obj.size / wordSize) {
+		if obj.pointerAt(word) {
+			slot := addr + uintptr(word)*wordSize
+			value, _ := h.Load(slot)
+			fn(slot, value)
+		}
+	}
+}
+
+// release drops the object from the table and gives its memory back.
+// The free list is merged separately, so a sweep merges only once.
+func (h *Heap) release(addr uintptr) {
+	obj := h.objects[addr]
+	delete(h.objects, addr)
+	idx, _ := h.index(addr)
+	clear(h.words[idx : idx+int(obj.size/wordSize)])
+	h.free = append(h.free, span{addr: addr, size: obj.size})
+}
+
+func (h *Heap) mergeFree() {
+	slices.SortFunc(h.free, func(a, b span) int {
+		return cmp.Compare(a.addr, b.addr)
+	})
+	merged := h.free[:0]
+	for _, free := range h.free {
+		if n := len(merged); n > 0 && merged[n-1].addr+merged[n-1].size == free.addr {
+			merged[n-1].size += free.size
+			continue
+		}
+		merged = append(merged, free)
+	}
+	h.free = merged
+}
+
+// Fragmentation is 1 - largest free span / free bytes: 0 when all free
+// memory is one span.
+func (h *Heap) Fragmentation() float64 {
+	var total, largest uintptr
+	for _, free := range h.free {
+		total += free.size
+		largest = max(largest, free.size)
+	}
+	if total == 0 {
+		return 0
+	}
+	return 1 - float64(largest)/float64(total)
+}
+
+func alignUp(value, align uintptr) uintptr {
+	return (value + align - 1) &^ (align - 1)
+}
+
+func TestHeapCollect(t *testing.T) {
+	heap := NewHeap(0x1000, 12*wordSize)
+	_, err := heap.Alloc(^uintptr(0))
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+
+	var objects []uintptr
+	for range 6 {
+		addr, err := heap.Alloc(2 * wordSize)
+		assert.NoError(t, err)
+		objects = append(objects, addr)
+	}
+	_, err = heap.Alloc(1)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+
+	// 0 -> 1 -> 2, 3 -> 4 -> 3 is an unreachable cycle, 5 is garbage
+	assert.NoError(t, heap.Store(objects[0], objects[1]))
+	assert.NoError(t, heap.Store(objects[1], objects[2]))
+	assert.NoError(t, heap.Store(objects[1]+wordSize, 42))
+	assert.NoError(t, heap.Store(objects[3], objects[4]))
+	assert.NoError(t, heap.Store(objects[4], objects[3]))
+
+	stats := heap.Collect([][]uintptr{{0, objects[0], 7}, {objects[2]}})
+	assert.Equal(t, CollectStats{
+		MarkedObjects: 3,
+		FreedObjects:  3,
+		FreedBytes:    6 * wordSize,
+		LiveObjects:   3,
+		LiveBytes:     6 * wordSize,
+	}, stats)
+	assert.Equal(t, []span{{addr: objects[3], size: 6 * wordSize}}, heap.free)
+	value, err := heap.Load(objects[1] + wordSize)
+	assert.NoError(t, err)
+	assert.Equal(t, uintptr(42), value)
+
+	big, err := heap.Alloc(6 * wordSize)
+	assert.NoError(t, err)
+	assert.Equal(t, objects[3], big)
+	value, err = heap.Load(objects[4])
+	assert.NoError(t, err)
+	assert.Zero(t, value)
+
+	stats = heap.Collect(nil)
+	assert.Equal(t, 4, stats.FreedObjects)
+	assert.Equal(t, []span{{addr: 0x1000, size: 12 * wordSize}}, heap.free)
+}
+
+func TestHeapAddresses(t *testing.T) {
+	heap := NewHeap(0x1000, 4*wordSize)
+	_, err := heap.Load(0x0)
+	assert.ErrorIs(t, err, ErrInvalidAddress)
+	_, err = heap.Load(0x1000 + 4*wordSize)
+	assert.ErrorIs(t, err, ErrInvalidAddress)
+	assert.ErrorIs(t, heap.Store(0x1001, 1), ErrInvalidAddress)
+	assert.NoError(t, heap.Store(0x1000+3*wordSize, 1))
+
+	obj, err := heap.Alloc(2 * wordSize)
+	assert.NoError(t, err)
+	start, _, ok := heap.objectAt(obj + wordSize + 1)
+	assert.True(t, ok)
+	assert.Equal(t, obj, start)
+	_, _, ok = heap.objectAt(obj + 2*wordSize)
+	assert.False(t, ok)
+	_, _, ok = heap.objectAt(0x10)
+	assert.False(t, ok)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
 	"testing"
 	"unsafe"
@@ -10,11 +12,40 @@ import (
 
 // go test -v homework_test.go
 
-func Trace(stacks [][]uintptr) []uintptr {
+const wordSize = unsafe.Sizeof(uintptr(0))
+
+var (
+	ErrInvalidAddress = errors.New("invalid address")
+	ErrInvalidSpan    = errors.New("invalid heap span")
+)
+
+// Memory is the address space Trace reads pointers from. Load fails for
+// addresses that are not mapped instead of crashing the process.
+type Memory interface {
+	Load(addr uintptr) (uintptr, error)
+}
+
+// wordMemory is a simulated address space of words starting at base.
+type wordMemory struct {
+	base  uintptr
+	words []uintptr
+}
+
+func (m wordMemory) Load(addr uintptr) (uintptr, error) {
+	if addr < m.base || addr-m.base >= uintptr(len(m.words))*wordSize || (addr-m.base)%wordSize != 0 {
+		return 0, fmt.Errorf("%w: %#x", ErrInvalidAddress, addr)
+	}
+	return m.words[(addr-m.base)/wordSize], nil
+}
+
+// Trace returns the addresses reachable from the stacks. Addresses that
+// cannot be loaded are left out of the result and reported in the error.
+func Trace(memory Memory, stacks [][]uintptr) ([]uintptr, error) {
 
 	var (
 		stack, result []uintptr
 		visited       = make(map[uintptr]struct{})
+		errs          []error
 	)
 
 	for i := len(stacks) - 1; i >= 0; i-- {
@@ -31,10 +62,14 @@ func Trace(stacks [][]uintptr) []uintptr {
 
 	for len(stack) > 0 {
 		currentPtr := stack[len(stack)-1]
-		result = append(result, currentPtr)
 		stack = stack[:len(stack)-1]
 
-		ptrValue := *(*uintptr)(unsafe.Pointer(currentPtr))
+		ptrValue, err := memory.Load(currentPtr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		result = append(result, currentPtr)
 		if ptrValue == 0 {
 			continue
 		}
@@ -46,51 +81,164 @@ func Trace(stacks [][]uintptr) []uintptr {
 		visited[ptrValue] = struct{}{}
 	}
 
-	return result
+	return result, errors.Join(errs...)
+}
+
+// HeapSpan is a run of objects of one size, like a span of the Go runtime.
+type HeapSpan struct {
+	Base, Size, ObjectSize uintptr
+}
+
+// Conservative traces stacks whose words may be integers that only look
+// like pointers: a word is a root only if it points into one of the heap
+// spans, at the start of an object or, with Interior, anywhere inside it.
+// Interior pointers are traced from the object start.
+type Conservative struct {
+	Spans    []HeapSpan
+	Interior bool
+}
+
+type ScanStats struct {
+	Candidates int // non-zero stack words
+	Retained   int
+	Rejected   int
+}
+
+func (c Conservative) Trace(memory Memory, stacks [][]uintptr) ([]uintptr, ScanStats, error) {
+	var stats ScanStats
+	for _, span := range c.Spans {
+		if span.ObjectSize == 0 {
+			return nil, stats, fmt.Errorf("%w: span at %#x has objects of size 0", ErrInvalidSpan, span.Base)
+		}
+	}
+	roots := make([][]uintptr, len(stacks))
+	for i, stack := range stacks {
+		roots[i] = make([]uintptr, len(stack))
+		for j, word := range stack {
+			if word == 0 {
+				continue
+			}
+			stats.Candidates++
+			if start, ok := c.objectStart(word); ok {
+				roots[i][j] = start
+				stats.Retained++
+			} else {
+				stats.Rejected++
+			}
+		}
+	}
+	pointers, err := Trace(memory, roots)
+	return pointers, stats, err
+}
+
+func (c Conservative) objectStart(addr uintptr) (uintptr, bool) {
+	for _, span := range c.Spans {
+		if addr < span.Base || addr-span.Base >= span.Size/span.ObjectSize*span.ObjectSize {
+			continue
+		}
+		offset := (addr - span.Base) % span.ObjectSize
+		if offset != 0 && !c.Interior {
+			return 0, false
+		}
+		return addr - offset, true
+	}
+	return 0, false
 }
 
 func TestTrace(t *testing.T) {
-	var heapObjects = []int{
-		0x00, 0x00, 0x00, 0x00, 0x00,
+	const base = 0x1000
+	addr := func(word int) uintptr {
+		return base + uintptr(word)*wordSize
 	}
 
-	var heapPointer1 *int = &heapObjects[1]
-	var heapPointer2 *int = &heapObjects[2]
-	var heapPointer3 *int = nil
-	var heapPointer4 **int = &heapPointer3
+	// words 0-4 are heapObjects, 5-8 are heapPointer1-4
+	var (
+		heapObjects  = []uintptr{addr(0), addr(1), addr(2), addr(3), addr(4)}
+		heapPointer1 = addr(5)
+		heapPointer2 = addr(6)
+		heapPointer3 = addr(7)
+		heapPointer4 = addr(8)
+	)
+	memory := wordMemory{base: base, words: []uintptr{
+		0x00, 0x00, 0x00, 0x00, 0x00,
+		heapObjects[1], heapObjects[2], 0x00, heapPointer3,
+	}}
 
 	var stacks = [][]uintptr{
 		{
-			uintptr(unsafe.Pointer(&heapPointer1)), 0x00, 0x00, 0x00,
+			heapPointer1, 0x00, 0x00, 0x00,
 			0x00, 0x00, 0x00, 0x00,
-			0x00, 0x00, 0x00, uintptr(unsafe.Pointer(&heapObjects[0])),
+			0x00, 0x00, 0x00, heapObjects[0],
 			0x00, 0x00, 0x00, 0x00,
 		},
 		{
-			uintptr(unsafe.Pointer(&heapPointer2)), 0x00, 0x00, 0x00,
-			0x00, 0x00, 0x00, uintptr(unsafe.Pointer(&heapObjects[1])),
-			0x00, 0x00, 0x00, uintptr(unsafe.Pointer(&heapObjects[2])),
-			uintptr(unsafe.Pointer(&heapPointer4)), 0x00, 0x00, 0x00,
+			heapPointer2, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, heapObjects[1],
+			0x00, 0x00, 0x00, heapObjects[2],
+			heapPointer4, 0x00, 0x00, 0x00,
 		},
 		{
 			0x00, 0x00, 0x00, 0x00,
 			0x00, 0x00, 0x00, 0x00,
 			0x00, 0x00, 0x00, 0x00,
-			0x00, 0x00, 0x00, uintptr(unsafe.Pointer(&heapObjects[3])),
+			0x00, 0x00, 0x00, heapObjects[3],
 		},
 	}
 
-	pointers := Trace(stacks)
+	pointers, err := Trace(memory, stacks)
+	assert.NoError(t, err)
 	expectedPointers := []uintptr{
-		uintptr(unsafe.Pointer(&heapPointer1)),
-		uintptr(unsafe.Pointer(&heapObjects[0])),
-		uintptr(unsafe.Pointer(&heapPointer2)),
-		uintptr(unsafe.Pointer(&heapObjects[1])),
-		uintptr(unsafe.Pointer(&heapObjects[2])),
-		uintptr(unsafe.Pointer(&heapPointer4)),
-		uintptr(unsafe.Pointer(&heapPointer3)),
-		uintptr(unsafe.Pointer(&heapObjects[3])),
+		heapPointer1,
+		heapObjects[0],
+		heapPointer2,
+		heapObjects[1],
+		heapObjects[2],
+		heapPointer4,
+		heapPointer3,
+		heapObjects[3],
 	}
 
 	assert.True(t, reflect.DeepEqual(expectedPointers, pointers))
 }
+
+func TestTraceInvalidAddress(t *testing.T) {
+	memory := wordMemory{base: 0x1000, words: []uintptr{0x1008, 0xdeadbeef, 0x00}}
+
+	// 42 is an integer on the stack, 0x1001 is not word aligned
+	pointers, err := Trace(memory, [][]uintptr{{0x1000, 42}, {0x1001}})
+	assert.Equal(t, []uintptr{0x1000, 0x1008}, pointers)
+	assert.ErrorIs(t, err, ErrInvalidAddress)
+	for _, addr := range []string{"0x2a", "0xdeadbeef", "0x1001"} {
+		assert.ErrorContains(t, err, addr)
+	}
+}
+
+func TestTraceConservative(t *testing.T) {
+	memory := wordMemory{base: 0x1000, words: make([]uintptr, 0x3040/wordSize)}
+	memory.words[0] = 0x1020
+	spans := []HeapSpan{
+		{Base: 0x1000, Size: 0x110, ObjectSize: 32},
+		{Base: 0x4000, Size: 0x40, ObjectSize: 16},
+	}
+	stacks := [][]uintptr{
+		{42, 0x1000, 0x00, 0x1010},
+		{0x4010, 0x2000, 0x1008, 0x1100},
+	}
+
+	precise := Conservative{Spans: spans}
+	pointers, stats, err := precise.Trace(memory, stacks)
+	assert.NoError(t, err)
+	assert.Equal(t, []uintptr{0x1000, 0x1020, 0x4010}, pointers)
+	assert.Equal(t, ScanStats{Candidates: 7, Retained: 2, Rejected: 5}, stats)
+
+	interior := Conservative{Spans: spans, Interior: true}
+	pointers, stats, err = interior.Trace(memory, stacks)
+	assert.NoError(t, err)
+	// 0x1008 in the second stack makes 0x1000 a root deeper in the search
+	assert.Equal(t, []uintptr{0x4010, 0x1000, 0x1020}, pointers)
+	assert.Equal(t, ScanStats{Candidates: 7, Retained: 4, Rejected: 3}, stats)
+
+	broken := Conservative{Spans: append(spans, HeapSpan{Base: 0x5000, Size: 0x40})}
+	_, _, err = broken.Trace(memory, stacks)
+	assert.ErrorIs(t, err, ErrInvalidSpan)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type MarkStats struct {
+	Marked int
+	// Scanned is the number of objects scanned by every worker.
+	Scanned []int
+	Steals  int
+}
+
+type markBits []atomic.Uint64
+
+// set reports whether the bit was clear before.
+func (b markBits) set(i int) bool {
+	mask := uint64(1) << (i % 64)
+	return b[i/64].Or(mask)&mask == 0
+}
+
+type deque struct {
+	mu    sync.Mutex
+	items []uintptr
+}
+
+func (d *deque) push(addr uintptr) {
+	d.mu.Lock()
+	d.items = append(d.items, addr)
+	d.mu.Unlock()
+}
+
+func (d *deque) pop() (uintptr, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.items) == 0 {
+		return 0, false
+	}
+	addr := d.items[len(d.items)-1]
+	d.items = d.items[:len(d.items)-1]
+	return addr, true
+}
+
+// steal takes the older half of the items.
+func (d *deque) steal() []uintptr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := (len(d.items) + 1) / 2
+	stolen := append([]uintptr(nil), d.items[:n]...)
+	d.items = append(d.items[:0], d.items[n:]...)
+	return stolen
+}
+
+// parallelMarker marks the heap with several goroutines. Every worker owns a
+// deque of grey objects: it pushes and pops at the bottom, idle workers
+// steal half of the deque from the top. Mark bits live in a shared bitmap
+// with one bit per heap word and are set with atomic operations, so every
+// object is scanned exactly once. pending counts grey objects of all
+// deques; marking is over when it drops to zero.
+type parallelMarker struct {
+	heap    *Heap
+	bits    markBits
+	deques  []*deque
+	pending atomic.Int64
+	steals  atomic.Int64
+}
+
+// ParallelMark marks the objects reachable from the stacks, like mark does,
+// using the given number of workers.
+func (h *Heap) ParallelMark(stacks [][]uintptr, workers int) MarkStats {
+	workers = max(workers, 1)
+	m := &parallelMarker{
+		heap:   h,
+		bits:   make(markBits, (len(h.words)+63)/64),
+		deques: make([]*deque, workers),
+	}
+	for i := range m.deques {
+		m.deques[i] = &deque{}
+	}
+	next := 0
+	for _, roots := range stacks {
+		for _, root := range roots {
+			if m.shade(m.deques[next], root) {
+				next = (next + 1) % workers
+			}
+		}
+	}
+
+	stats := MarkStats{Scanned: make([]int, workers)}
+	var wg sync.WaitGroup
+	for id := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stats.Scanned[id] = m.work(id)
+		}()
+	}
+	wg.Wait()
+
+	for addr, obj := range h.objects {
+		if idx, _ := h.index(addr); m.bits[idx/64].Load()&(1<<(idx%64)) != 0 {
+			obj.marked = true
+			stats.Marked++
+		}
+	}
+	stats.Steals = int(m.steals.Load())
+	return stats
+}
+
+// CollectParallel is Collect with the mark phase done by ParallelMark.
+func (h *Heap) CollectParallel(stacks [][]uintptr, workers int) CollectStats {
+	stats := CollectStats{MarkedObjects: h.ParallelMark(stacks, workers).Marked}
+	h.sweep(&stats)
+	return stats
+}
+
+func (m *parallelMarker) work(id int) int {
+	own := m.deques[id]
+	random := rand.New(rand.NewPCG(uint64(id), 0))
+	scanned := 0
+	for {
+		addr, ok := own.pop()
+		if !ok {
+			if m.stealFor(own, random) {
+				continue
+			}
+			if m.pending.Load() == 0 {
+				return scanned
+			}
+			runtime.Gosched()
+			continue
+		}
+
+		m.heap.forEachPointer(addr, func(_, value uintptr) {
+			m.shade(own, value)
+		})
+		scanned++
+		m.pending.Add(-1)
+	}
+}
+
+// shade marks an unmarked object and puts it on the deque. pending grows
+// before the object becomes visible to other workers.
+func (m *parallelMarker) shade(d *deque, addr uintptr) bool {
+	if _, ok := m.heap.objects[addr]; !ok {
+		return false
+	}
+	idx, _ := m.heap.index(addr)
+	if !m.bits.set(idx) {
+		return false
+	}
+	m.pending.Add(1)
+	d.push(addr)
+	return true
+}
+
+func (m *parallelMarker) stealFor(own *deque, random *rand.Rand) bool {
+	start := random.IntN(len(m.deques))
+	for i := range m.deques {
+		victim := m.deques[(start+i)%len(m.deques)]
+		if victim == own {
+			continue
+		}
+		if stolen := victim.steal(); len(stolen) > 0 {
+			own.mu.Lock()
+			own.items = append(own.items, stolen...)
+			own.mu.Unlock()
+			m.steals.Add(1)
+			return true
+		}
+	}
+	return false
+}
+
+// randomHeap builds a heap of objects with four pointer fields; about a
+// third of the fields are nil.
+func randomHeap(seed uint64, objects int) (*Heap, []uintptr) {
+	random := rand.New(rand.NewPCG(seed, 0))
+	node := NewType("node", 4*wordSize, 0, 1, 2, 3)
+	heap := NewHeap(0x10000, uintptr(objects)*node.Size)
+	addrs := make([]uintptr, objects)
+	for i := range addrs {
+		addrs[i], _ = heap.AllocTyped(node)
+	}
+	for _, addr := range addrs {
+		for field := range uintptr(4) {
+			if random.IntN(3) > 0 {
+				_ = heap.Store(addr+field*wordSize, addrs[random.IntN(objects)])
+			}
+		}
+	}
+	return heap, addrs
+}
+
+func marked(heap *Heap) map[uintptr]bool {
+	result := make(map[uintptr]bool)
+	for addr, obj := range heap.objects {
+		if obj.marked {
+			result[addr] = true
+			obj.marked = false
+		}
+	}
+	return result
+}
+
+func TestParallelMark(t *testing.T) {
+	heap, addrs := randomHeap(1, 20000)
+	stacks := [][]uintptr{{addrs[0], 7, 0}, {addrs[100], addrs[200]}, {0x10000 + 3}}
+
+	heap.mark(stacks)
+	expected := marked(heap)
+	assert.Less(t, len(expected), len(addrs))
+
+	for _, workers := range []int{1, 4, 8} {
+		stats := heap.ParallelMark(stacks, workers)
+		assert.Equal(t, len(expected), stats.Marked)
+		assert.Equal(t, expected, marked(heap))
+
+		total := 0
+		for _, scanned := range stats.Scanned {
+			total += scanned
+		}
+		assert.Equal(t, len(expected), total)
+	}
+}
+
+func TestCollectParallel(t *testing.T) {
+	// a long chain has one grey object at a time, so workers mostly wait
+	heap := NewHeap(0x1000, 1000*wordSize)
+	next := NewType("*node", wordSize, 0)
+	var prev uintptr
+	for range 999 {
+		addr, err := heap.AllocTyped(next)
+		assert.NoError(t, err)
+		assert.NoError(t, heap.Store(addr, prev))
+		prev = addr
+	}
+	garbage, err := heap.AllocTyped(next)
+	assert.NoError(t, err)
+	assert.NoError(t, heap.Store(garbage, prev))
+
+	stats := heap.CollectParallel([][]uintptr{{prev}}, 4)
+	assert.Equal(t, CollectStats{
+		MarkedObjects: 999,
+		FreedObjects:  1,
+		FreedBytes:    wordSize,
+		LiveObjects:   999,
+		LiveBytes:     999 * wordSize,
+	}, stats)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// RefCounted is a reference counted heap. References from the stacks are
+// counted through IncRef and DecRef, pointer fields through Write, and an
+// object is freed as soon as its count drops to zero. Garbage cycles keep
+// their counts above zero; CollectCycles finds them with the synchronous
+// trial deletion algorithm of Bacon and Rajan.
+type RefCounted struct {
+	heap   *Heap
+	states map[uintptr]*rcState
+	// possible roots of garbage cycles: objects whose count was decremented
+	// to a non-zero value
+	roots []uintptr
+}
+
+type rcColor uint8
+
+const (
+	rcBlack  rcColor = iota // in use or free
+	rcGray                  // possible member of a cycle
+	rcWhite                 // member of a garbage cycle
+	rcPurple                // possible root of a cycle
+)
+
+type rcState struct {
+	count    int
+	color    rcColor
+	buffered bool
+}
+
+type CycleStats struct {
+	Candidates   int
+	FreedObjects int
+	FreedBytes   uintptr
+}
+
+func NewRefCounted(heap *Heap) *RefCounted {
+	return &RefCounted{heap: heap, states: make(map[uintptr]*rcState)}
+}
+
+// Alloc returns an object with a count of one, the reference of the caller.
+func (rc *RefCounted) Alloc(typ *TypeDesc) (uintptr, error) {
+	addr, err := rc.heap.AllocTyped(typ)
+	if err != nil {
+		return 0, err
+	}
+	rc.states[addr] = &rcState{count: 1}
+	return addr, nil
+}
+
+func (rc *RefCounted) IncRef(addr uintptr) {
+	if state, ok := rc.states[addr]; ok {
+		state.count++
+		state.color = rcBlack
+	}
+}
+
+func (rc *RefCounted) DecRef(addr uintptr) {
+	state, ok := rc.states[addr]
+	if !ok {
+		return
+	}
+	if state.count--; state.count == 0 {
+		rc.release(addr)
+		return
+	}
+	if state.color != rcPurple {
+		state.color = rcPurple
+		if !state.buffered {
+			state.buffered = true
+			rc.roots = append(rc.roots, addr)
+		}
+	}
+}
+
+// Write stores value into the pointer field at addr, counting the new
+// reference before dropping the old one.
+func (rc *RefCounted) Write(addr, value uintptr) error {
+	old, err := rc.heap.Load(addr)
+	if err != nil {
+		return err
+	}
+	rc.IncRef(value)
+	if err := rc.heap.Store(addr, value); err != nil {
+		return err
+	}
+	rc.DecRef(old)
+	return nil
+}
+
+func (rc *RefCounted) Count(addr uintptr) int {
+	if state, ok := rc.states[addr]; ok {
+		return state.count
+	}
+	return 0
+}
+
+// CollectCycles frees garbage cycles reachable from the possible roots.
+func (rc *RefCounted) CollectCycles() CycleStats {
+	stats := CycleStats{Candidates: len(rc.roots)}
+
+	// subtract internal references from every subgraph of a candidate
+	roots := rc.roots[:0]
+	for _, addr := range rc.roots {
+		state := rc.states[addr]
+		if state.color == rcPurple && state.count > 0 {
+			rc.markGray(addr)
+			roots = append(roots, addr)
+			continue
+		}
+		state.buffered = false
+		if state.color == rcBlack && state.count == 0 {
+			rc.free(addr, &stats)
+		}
+	}
+	// objects still referenced from outside restore their subgraphs
+	for _, addr := range roots {
+		rc.scan(addr)
+	}
+	for _, addr := range roots {
+		rc.states[addr].buffered = false
+		rc.collectWhite(addr, &stats)
+	}
+	rc.roots = nil
+	rc.heap.mergeFree()
+	return stats
+}
+
+func (rc *RefCounted) release(addr uintptr) {
+	rc.forEachChild(addr, rc.DecRef)
+	state := rc.states[addr]
+	state.color = rcBlack
+	if !state.buffered {
+		var stats CycleStats
+		rc.free(addr, &stats)
+		rc.heap.mergeFree()
+	}
+}
+
+func (rc *RefCounted) markGray(addr uintptr) {
+	state := rc.states[addr]
+	if state.color == rcGray {
+		return
+	}
+	state.color = rcGray
+	rc.forEachChild(addr, func(child uintptr) {
+		rc.states[child].count--
+		rc.markGray(child)
+	})
+}
+
+func (rc *RefCounted) scan(addr uintptr) {
+	state := rc.states[addr]
+	if state.color != rcGray {
+		return
+	}
+	if state.count > 0 {
+		rc.scanBlack(addr)
+		return
+	}
+	state.color = rcWhite
+	rc.forEachChild(addr, rc.scan)
+}
+
+func (rc *RefCounted) scanBlack(addr uintptr) {
+	rc.states[addr].color = rcBlack
+	rc.forEachChild(addr, func(child uintptr) {
+		state := rc.states[child]
+		state.count++
+		if state.color != rcBlack {
+			rc.scanBlack(child)
+		}
+	})
+}
+
+func (rc *RefCounted) collectWhite(addr uintptr, stats *CycleStats) {
+	// a child referred to by several fields is freed on the first visit
+	state, ok := rc.states[addr]
+	if !ok || state.color != rcWhite || state.buffered {
+		return
+	}
+	state.color = rcBlack
+	rc.forEachChild(addr, func(child uintptr) {
+		rc.collectWhite(child, stats)
+	})
+	rc.free(addr, stats)
+}
+
+func (rc *RefCounted) free(addr uintptr, stats *CycleStats) {
+	stats.FreedObjects++
+	stats.FreedBytes += rc.heap.objects[addr].size
+	delete(rc.states, addr)
+	rc.heap.release(addr)
+}
+
+// forEachChild calls fn for every object the pointer fields of addr refer
+// to. fn sees the children before the object is freed.
+func (rc *RefCounted) forEachChild(addr uintptr, fn func(child uintptr)) {
+	var children []uintptr
+	rc.heap.forEachPointer(addr, func(_, value uintptr) {
+		if _, ok := rc.states[value]; ok {
+			children = append(children, value)
+		}
+	})
+	for _, child := range children {
+		fn(child)
+	}
+}
+
+func TestRefCountedRelease(t *testing.T) {
+	heap := NewHeap(0x1000, 16*wordSize)
+	rc := NewRefCounted(heap)
+	node := NewType("node", 2*wordSize, 0, 1)
+
+	parent, _ := rc.Alloc(node)
+	child, _ := rc.Alloc(node)
+	assert.NoError(t, rc.Write(parent, child))
+	assert.NoError(t, rc.Write(parent+wordSize, child))
+	rc.DecRef(child)
+	assert.Equal(t, 2, rc.Count(child))
+
+	assert.NoError(t, rc.Write(parent+wordSize, 0))
+	assert.Equal(t, 1, rc.Count(child))
+	rc.DecRef(parent)
+	assert.NotContains(t, heap.objects, parent)
+	// child is in the buffer of possible roots, it is freed with the cycles
+	assert.Zero(t, rc.Count(child))
+	assert.Contains(t, heap.objects, child)
+	assert.Equal(t, CycleStats{Candidates: 1, FreedObjects: 1, FreedBytes: 2 * wordSize}, rc.CollectCycles())
+	assert.Empty(t, heap.objects)
+	assert.Equal(t, []span{{addr: 0x1000, size: 16 * wordSize}}, heap.free)
+}
+
+func TestRefCountedCycles(t *testing.T) {
+	heap := NewHeap(0x1000, 16*wordSize)
+	rc := NewRefCounted(heap)
+	node := NewType("node", 2*wordSize, 0, 1)
+
+	// a <-> b, only the stack refers to a
+	a, _ := rc.Alloc(node)
+	b, _ := rc.Alloc(node)
+	assert.NoError(t, rc.Write(a, b))
+	assert.NoError(t, rc.Write(b, a))
+	rc.DecRef(b)
+	// c -> d -> c, and e -> c keeps the cycle alive
+	c, _ := rc.Alloc(node)
+	d, _ := rc.Alloc(node)
+	e, _ := rc.Alloc(node)
+	assert.NoError(t, rc.Write(c, d))
+	assert.NoError(t, rc.Write(d, c))
+	assert.NoError(t, rc.Write(e, c))
+	rc.DecRef(d)
+
+	rc.DecRef(a)
+	rc.DecRef(c)
+	assert.Len(t, heap.objects, 5)
+	assert.Equal(t, 1, rc.Count(a))
+
+	stats := rc.CollectCycles()
+	assert.Equal(t, CycleStats{Candidates: 4, FreedObjects: 2, FreedBytes: 4 * wordSize}, stats)
+	assert.NotContains(t, heap.objects, a)
+	assert.NotContains(t, heap.objects, b)
+	assert.Equal(t, 2, rc.Count(c))
+	assert.Equal(t, 1, rc.Count(d))
+
+	// dropping e turns the second cycle into garbage
+	rc.DecRef(e)
+	assert.Equal(t, 1, rc.Count(c))
+	stats = rc.CollectCycles()
+	assert.Equal(t, 2, stats.FreedObjects)
+	assert.Empty(t, heap.objects)
+	assert.Equal(t, []span{{addr: 0x1000, size: 16 * wordSize}}, heap.free)
+}
+
+func TestRefCountedSharedChild(t *testing.T) {
+	heap := NewHeap(0x1000, 16*wordSize)
+	rc := NewRefCounted(heap)
+	node := NewType("node", 2*wordSize, 0, 1)
+
+	// r -> a, both fields of a refer to b, b -> r
+	r, _ := rc.Alloc(node)
+	a, _ := rc.Alloc(node)
+	b, _ := rc.Alloc(node)
+	assert.NoError(t, rc.Write(r, a))
+	assert.NoError(t, rc.Write(a, b))
+	assert.NoError(t, rc.Write(a+wordSize, b))
+	assert.NoError(t, rc.Write(b, r))
+	rc.DecRef(r)
+	rc.DecRef(a)
+	rc.DecRef(b)
+	assert.Equal(t, 2, rc.Count(b))
+
+	assert.Equal(t, CycleStats{Candidates: 3, FreedObjects: 3, FreedBytes: 6 * wordSize}, rc.CollectCycles())
+	assert.Empty(t, heap.objects)
+	assert.Equal(t, []span{{addr: 0x1000, size: 16 * wordSize}}, heap.free)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type Color uint8
+
+const (
+	White Color = iota // not reached yet, freed by the sweep
+	Grey               // reached, fields not scanned yet
+	Black              // reached and scanned
+)
+
+// Marker marks the heap incrementally while the mutator keeps running.
+// The mutator must change pointer fields through Write, so the write
+// barrier can keep the invariant the marker relies on. Stacks are not
+// protected by the barrier; Finish rescans them before sweeping.
+type Marker struct {
+	heap    *Heap
+	barrier WriteBarrier
+	stacks  [][]uintptr
+	colors  map[uintptr]Color
+	grey    []uintptr
+	marking bool
+}
+
+// WriteBarrier is called by Marker.Write while marking, before a pointer
+// field changes from old to value.
+type WriteBarrier interface {
+	Write(m *Marker, old, value uintptr)
+}
+
+// NoBarrier lets the mutator hide objects from the marker; it only exists
+// to show what the barriers prevent.
+type NoBarrier struct{}
+
+func (NoBarrier) Write(*Marker, uintptr, uintptr) {}
+
+// Dijkstra is the insertion barrier: a pointer stored into the heap is
+// shaded, so a black object never points to a white one.
+type Dijkstra struct{}
+
+func (Dijkstra) Write(m *Marker, _, value uintptr) {
+	m.shade(value)
+}
+
+// Yuasa is the deletion barrier: an overwritten pointer is shaded, so
+// everything reachable when marking started survives (snapshot at the
+// beginning).
+type Yuasa struct{}
+
+func (Yuasa) Write(m *Marker, old, _ uintptr) {
+	m.shade(old)
+}
+
+func NewMarker(heap *Heap, barrier WriteBarrier) *Marker {
+	return &Marker{heap: heap, barrier: barrier}
+}
+
+// Start shades the roots. The stacks may be changed by the mutator until
+// Finish.
+func (m *Marker) Start(stacks [][]uintptr) {
+	m.stacks = stacks
+	m.colors = make(map[uintptr]Color)
+	m.grey = nil
+	m.marking = true
+	m.shadeRoots()
+}
+
+// Step scans at most budget grey objects and reports whether no grey
+// objects are left.
+func (m *Marker) Step(budget int) bool {
+	for ; budget > 0 && len(m.grey) > 0; budget-- {
+		current := m.grey[len(m.grey)-1]
+		m.grey = m.grey[:len(m.grey)-1]
+		children := len(m.grey)
+		m.heap.forEachPointer(current, func(_, value uintptr) {
+			m.shade(value)
+		})
+		slices.Reverse(m.grey[children:])
+		m.colors[current] = Black
+	}
+	return len(m.grey) == 0
+}
+
+// Finish rescans the stacks, marks what is left and sweeps white objects.
+func (m *Marker) Finish() CollectStats {
+	m.shadeRoots()
+	for !m.Step(len(m.grey)) {
+	}
+	m.marking = false
+
+	var stats CollectStats
+	for addr, obj := range m.heap.objects {
+		if m.colors[addr] != White {
+			obj.marked = true
+			stats.MarkedObjects++
+		}
+	}
+	m.heap.sweep(&stats)
+	m.colors = nil
+	return stats
+}
+
+func (m *Marker) Color(addr uintptr) Color {
+	return m.colors[addr]
+}
+
+// Alloc allocates black while marking: a new object cannot have been
+// reached yet, but it is live.
+func (m *Marker) Alloc(typ *TypeDesc) (uintptr, error) {
+	addr, err := m.heap.AllocTyped(typ)
+	if err == nil && m.marking {
+		m.colors[addr] = Black
+	}
+	return addr, err
+}
+
+func (m *Marker) Write(addr, value uintptr) error {
+	old, err := m.heap.Load(addr)
+	if err != nil {
+		return err
+	}
+	if m.marking {
+		m.barrier.Write(m, old, value)
+	}
+	return m.heap.Store(addr, value)
+}
+
+func (m *Marker) shadeRoots() {
+	for i := len(m.stacks) - 1; i >= 0; i-- {
+		for j := len(m.stacks[i]) - 1; j >= 0; j-- {
+			m.shade(m.stacks[i][j])
+		}
+	}
+}
+
+func (m *Marker) shade(addr uintptr) {
+	if _, ok := m.heap.objects[addr]; ok && m.colors[addr] == White {
+		m.colors[addr] = Grey
+		m.grey = append(m.grey, addr)
+	}
+}
+
+// reachable returns the objects reachable from the stacks without
+// touching the marks of the heap.
+func reachable(heap *Heap, stacks [][]uintptr) map[uintptr]bool {
+	seen := make(map[uintptr]bool)
+	var stack []uintptr
+	for _, roots := range stacks {
+		stack = append(stack, roots...)
+	}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := heap.objects[current]; !ok || seen[current] {
+			continue
+		}
+		seen[current] = true
+		heap.forEachPointer(current, func(_, value uintptr) {
+			stack = append(stack, value)
+		})
+	}
+	return seen
+}
+
+func TestTriColorLostObject(t *testing.T) {
+	// a and b are roots, c is reachable only through b. After a is black
+	// the mutator moves the pointer to c from b to a.
+	tests := map[string]struct {
+		barrier WriteBarrier
+		lost    bool
+	}{
+		"no barrier": {barrier: NoBarrier{}, lost: true},
+		"dijkstra":   {barrier: Dijkstra{}},
+		"yuasa":      {barrier: Yuasa{}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			heap := NewHeap(0x1000, 16*wordSize)
+			node := NewType("node", wordSize, 0)
+			marker := NewMarker(heap, test.barrier)
+			a, _ := marker.Alloc(node)
+			b, _ := marker.Alloc(node)
+			c, _ := marker.Alloc(node)
+			assert.NoError(t, marker.Write(b, c))
+
+			marker.Start([][]uintptr{{a, b}})
+			assert.False(t, marker.Step(1))
+			assert.Equal(t, Black, marker.Color(a))
+			assert.Equal(t, Grey, marker.Color(b))
+			assert.Equal(t, White, marker.Color(c))
+
+			assert.NoError(t, marker.Write(a, c))
+			assert.NoError(t, marker.Write(b, 0))
+			stats := marker.Finish()
+
+			_, alive := heap.objects[c]
+			assert.Equal(t, test.lost, !alive)
+			if test.lost {
+				assert.Equal(t, 1, stats.FreedObjects)
+			} else {
+				assert.Equal(t, 3, stats.LiveObjects)
+			}
+		})
+	}
+}
+
+func TestTriColorRandomMutator(t *testing.T) {
+	for name, barrier := range map[string]WriteBarrier{"dijkstra": Dijkstra{}, "yuasa": Yuasa{}} {
+		t.Run(name, func(t *testing.T) {
+			random := rand.New(rand.NewPCG(1, 2))
+			node := NewType("node", 2*wordSize, 0, 1)
+			heap := NewHeap(0x1000, 1024*wordSize)
+			marker := NewMarker(heap, barrier)
+
+			objects := make([]uintptr, 64)
+			for i := range objects {
+				objects[i], _ = marker.Alloc(node)
+			}
+			for _, obj := range objects {
+				for field := range uintptr(2) {
+					if random.IntN(2) == 0 {
+						continue
+					}
+					assert.NoError(t, marker.Write(obj+field*wordSize, objects[random.IntN(len(objects))]))
+				}
+			}
+
+			// the first slot of every stack is never cleared, so something
+			// always stays reachable
+			stacks := [][]uintptr{objects}
+			for cycle := range 20 {
+				live := slices.Sorted(maps.Keys(reachable(heap, stacks)))
+				stacks = [][]uintptr{make([]uintptr, 4), make([]uintptr, 4)}
+				for _, roots := range stacks {
+					for i := range roots {
+						roots[i] = live[random.IntN(len(live))]
+					}
+				}
+
+				marker.Start(stacks)
+				for !marker.Step(1) {
+					// several changes per step, so the marker sees a moving graph
+					for range 4 {
+						live := slices.Sorted(maps.Keys(reachable(heap, stacks)))
+						pick := func() uintptr {
+							if random.IntN(4) == 0 {
+								return 0
+							}
+							return live[random.IntN(len(live))]
+						}
+						switch random.IntN(3) {
+						case 0:
+							stacks[random.IntN(2)][1+random.IntN(3)] = pick()
+						case 1:
+							field := live[random.IntN(len(live))] + uintptr(random.IntN(2))*wordSize
+							assert.NoError(t, marker.Write(field, pick()))
+						case 2:
+							obj, err := marker.Alloc(node)
+							if err == nil {
+								assert.NoError(t, marker.Write(obj, pick()))
+								field := live[random.IntN(len(live))] + uintptr(random.IntN(2))*wordSize
+								assert.NoError(t, marker.Write(field, obj))
+							}
+						}
+					}
+				}
+
+				expected := reachable(heap, stacks)
+				stats := marker.Finish()
+				for addr := range expected {
+					_, ok := heap.objects[addr]
+					assert.True(t, ok, "reachable object %#x freed in cycle %d", addr, cycle)
+				}
+				assert.GreaterOrEqual(t, stats.LiveObjects, len(expected))
+			}
+		})
+	}
+}
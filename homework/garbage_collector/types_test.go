@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TypeDesc describes the layout of heap objects like the runtime's _type:
+// the size in bytes and a bitmap with one bit per word, least significant
+// bit first, set for words that hold pointers. Words past the bitmap hold
+// no pointers.
+type TypeDesc struct {
+	Name      string
+	Size      uintptr
+	PtrBitmap []byte
+}
+
+// NewType describes a struct of size bytes with pointers in the given
+// words.
+func NewType(name string, size uintptr, pointerWords ...int) *TypeDesc {
+	typ := &TypeDesc{Name: name, Size: size}
+	for _, word := range pointerWords {
+		typ.setPointer(word)
+	}
+	return typ
+}
+
+// ArrayOf describes [n]elem; elem.Size must be a multiple of the word size.
+func ArrayOf(elem *TypeDesc, n int) *TypeDesc {
+	typ := &TypeDesc{Name: fmt.Sprintf("[%d]%s", n, elem.Name), Size: elem.Size * uintptr(n)}
+	words := int(elem.Size / wordSize)
+	for i := range n {
+		for word := range words {
+			if elem.pointerAt(word) {
+				typ.setPointer(i*words + word)
+			}
+		}
+	}
+	return typ
+}
+
+func (t *TypeDesc) pointerAt(word int) bool {
+	return word/8 < len(t.PtrBitmap) && t.PtrBitmap[word/8]&(1<<(word%8)) != 0
+}
+
+func (t *TypeDesc) setPointer(word int) {
+	for len(t.PtrBitmap) <= word/8 {
+		t.PtrBitmap = append(t.PtrBitmap, 0)
+	}
+	t.PtrBitmap[word/8] |= 1 << (word % 8)
+}
+
+func TestTypeDesc(t *testing.T) {
+	// struct { next *node; value int; left, right *node }
+	node := NewType("node", 4*wordSize, 0, 2, 3)
+	assert.Equal(t, []byte{0b1101}, node.PtrBitmap)
+
+	nodes := ArrayOf(node, 3)
+	assert.Equal(t, "[3]node", nodes.Name)
+	assert.Equal(t, 12*wordSize, nodes.Size)
+	assert.Equal(t, []byte{0b11011101, 0b1101}, nodes.PtrBitmap)
+	assert.False(t, nodes.pointerAt(12))
+	assert.False(t, nodes.pointerAt(100))
+}
+
+func TestPreciseScanning(t *testing.T) {
+	heap := NewHeap(0x1000, 64*wordSize)
+	node := NewType("node", 4*wordSize, 0, 2, 3)
+	pointers := ArrayOf(NewType("*int", wordSize, 0), 3)
+	data := NewType("[2]int", 2*wordSize)
+
+	alloc := func(typ *TypeDesc) uintptr {
+		addr, err := heap.AllocTyped(typ)
+		assert.NoError(t, err)
+		return addr
+	}
+	root := alloc(node)
+	left, right, next := alloc(node), alloc(node), alloc(node)
+	array := alloc(pointers)
+	first, last := alloc(data), alloc(data)
+	// only reachable through the value word, which is not a pointer
+	hidden := alloc(node)
+
+	assert.NoError(t, heap.Store(root, next))
+	assert.NoError(t, heap.Store(root+wordSize, hidden))
+	assert.NoError(t, heap.Store(root+2*wordSize, left))
+	assert.NoError(t, heap.Store(root+3*wordSize, right))
+	assert.NoError(t, heap.Store(right+3*wordSize, array))
+	assert.NoError(t, heap.Store(array, first))
+	assert.NoError(t, heap.Store(array+2*wordSize, last))
+
+	stats := heap.Collect([][]uintptr{{root}})
+	assert.Equal(t, 7, stats.MarkedObjects)
+	assert.Equal(t, 1, stats.FreedObjects)
+	assert.NotContains(t, heap.objects, hidden)
+	assert.Contains(t, heap.objects, last)
+}